@@ -0,0 +1,73 @@
+package main // "github.com/privacy-pal/privacy-pal/go/cmd/palverify"
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/privacy-pal/privacy-pal/go/pkg/report"
+)
+
+var (
+	key = flag.String("key", "", "file holding the Ed25519 public key, in hex or base64")
+)
+
+// Usage is a replacement usage function for the flags package.
+func Usage() {
+	fmt.Fprintf(os.Stderr, "Usage of palverify:\n")
+	fmt.Fprintf(os.Stderr, "\tpalverify -key public.key bundle.json\n")
+	fmt.Fprintf(os.Stderr, "Verifies a signed access report or deletion result without network access.\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+func readPublicKey(name string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	text := string(bytes.TrimSpace(data))
+	if decoded, err := hex.DecodeString(text); err == nil && len(decoded) == ed25519.PublicKeySize {
+		return decoded, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(text); err == nil && len(decoded) == ed25519.PublicKeySize {
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("%s does not hold a %d-byte Ed25519 public key in hex or base64", name, ed25519.PublicKeySize)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("palverify: ")
+	flag.Usage = Usage
+	flag.Parse()
+
+	if *key == "" || flag.NArg() != 1 {
+		log.Printf("need a key and one bundle. See 'palverify -help'.")
+		os.Exit(2)
+	}
+	publicKey, err := readPublicKey(*key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var bundle report.SignedBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		log.Fatalf("reading %s: %v", flag.Arg(0), err)
+	}
+
+	if err := report.Verify(&bundle, publicKey); err != nil {
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+	fmt.Printf("%s: valid %s signed at %s, %s\n", flag.Arg(0), bundle.Kind, bundle.SignedAt.Format(time.RFC3339), bundle.Hash)
+}
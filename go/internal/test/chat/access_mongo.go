@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	pal "github.com/privacy-pal/privacy-pal/go/pkg"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -61,24 +60,10 @@ func handleAccessUserMongo(dataSubjectId string, currentDbObjLocator pal.Locator
 			err = fmt.Errorf("invalid id")
 			return
 		}
-		var objectID primitive.ObjectID
-		objectID, err = primitive.ObjectIDFromHex(id)
-		if err != nil {
+		if err = checkObjectID(id); err != nil {
 			return
 		}
-
-		groupchatLocators = append(groupchatLocators, pal.Locator{
-			LocatorType: pal.Document,
-			DataType:    GroupChatDataType,
-			FirestoreLocator: pal.FirestoreLocator{
-				CollectionPath: []string{"gcs"},
-				DocIDs:         []string{id},
-			},
-			MongoLocator: pal.MongoLocator{
-				Collection: "gcs",
-				Filter:     bson.D{{Key: "_id", Value: objectID}},
-			},
-		})
+		groupchatLocators = append(groupchatLocators, pal.Ref("gcs", id).Locator(GroupChatDataType))
 	}
 	data["Groupchats"] = groupchatLocators
 
@@ -94,24 +79,10 @@ func handleAccessUserMongo(dataSubjectId string, currentDbObjLocator pal.Locator
 			err = fmt.Errorf("invalid id")
 			return
 		}
-		var dmIDObj primitive.ObjectID
-		dmIDObj, err = primitive.ObjectIDFromHex(dmID)
-		if err != nil {
+		if err = checkObjectID(dmID); err != nil {
 			return
 		}
-
-		directMessageLocators = append(directMessageLocators, pal.Locator{
-			LocatorType: pal.Document,
-			DataType:    DirectMessageDataType,
-			FirestoreLocator: pal.FirestoreLocator{
-				CollectionPath: []string{"dms"},
-				DocIDs:         []string{dmID},
-			},
-			MongoLocator: pal.MongoLocator{
-				Collection: "dms",
-				Filter:     bson.D{{Key: "_id", Value: dmIDObj}},
-			},
-		})
+		directMessageLocators = append(directMessageLocators, pal.Ref("dms", dmID).Locator(DirectMessageDataType))
 	}
 	data["DirectMessages"] = directMessageLocators
 
@@ -121,25 +92,12 @@ func handleAccessUserMongo(dataSubjectId string, currentDbObjLocator pal.Locator
 func handleAccessGroupChatMongo(dataSubjectId string, currentDbObjLocator pal.Locator, dbObj pal.DatabaseObject) (data map[string]interface{}, err error) {
 	data = make(map[string]interface{})
 
-	data["Messages"] = pal.Locator{
-		LocatorType: pal.Collection,
-		DataType:    MessageDataType,
-		FirestoreLocator: pal.FirestoreLocator{
-			CollectionPath: append(currentDbObjLocator.FirestoreLocator.CollectionPath, "messages"),
-			DocIDs:         currentDbObjLocator.DocIDs,
-			Filters: []pal.Filter{
-				{
-					Path:  "userId",
-					Op:    "==",
-					Value: dataSubjectId,
-				},
-			},
-		},
-		MongoLocator: pal.MongoLocator{
-			Collection: "messages",
-			Filter:     bson.D{{Key: "userId", Value: dataSubjectId}, {Key: "chatId", Value: dbObj["_id"]}},
-		},
+	id, ok := dbObj["_id"].(string)
+	if !ok {
+		err = fmt.Errorf("invalid id")
+		return
 	}
+	data["Messages"] = pal.Ref("gcs", id).Sub("messages").ParentField("chatId").Where("userId", "==", dataSubjectId).Locator(MessageDataType)
 
 	return
 }
@@ -172,43 +130,24 @@ func handleAccessDirectMessageMongo(dataSubjectId string, currentDbObjLocator pa
 	} else {
 		otherUserId = user1
 	}
-	var otherUserIDObj primitive.ObjectID
-	otherUserIDObj, err = primitive.ObjectIDFromHex(otherUserId)
-	if err != nil {
+	id, ok := dbObj["_id"].(string)
+	if !ok {
+		err = fmt.Errorf("invalid id")
 		return
 	}
-
-	data["Other User"] = pal.Locator{
-		LocatorType: pal.Document,
-		DataType:    UserDataType,
-		FirestoreLocator: pal.FirestoreLocator{
-			CollectionPath: []string{"users"},
-			DocIDs:         []string{otherUserId},
-		},
-		MongoLocator: pal.MongoLocator{
-			Collection: "users",
-			Filter:     bson.D{{Key: "_id", Value: otherUserIDObj}},
-		},
-	}
-	data["Messages"] = pal.Locator{
-		LocatorType: pal.Collection,
-		DataType:    MessageDataType,
-		FirestoreLocator: pal.FirestoreLocator{
-			CollectionPath: append(currentDbObjLocator.FirestoreLocator.CollectionPath, "messages"),
-			DocIDs:         currentDbObjLocator.DocIDs,
-			Filters: []pal.Filter{
-				{
-					Path:  "userId",
-					Op:    "==",
-					Value: dataSubjectId,
-				},
-			},
-		},
-		MongoLocator: pal.MongoLocator{
-			Collection: "messages",
-			Filter:     bson.D{{Key: "userId", Value: dataSubjectId}, {Key: "chatId", Value: dbObj["_id"]}},
-		},
+	if err = checkObjectID(otherUserId); err != nil {
+		return
 	}
+	data["Other User"] = pal.Ref("users", otherUserId).Locator(UserDataType)
+	data["Messages"] = pal.Ref("dms", id).Sub("messages").ParentField("chatId").Where("userId", "==", dataSubjectId).Locator(MessageDataType)
 
 	return
 }
+
+// checkObjectID returns an error if id is not an ObjectID hex string. pal.Ref
+// would otherwise look for a document with a string _id, which finds nothing
+// here.
+func checkObjectID(id string) error {
+	_, err := primitive.ObjectIDFromHex(id)
+	return err
+}
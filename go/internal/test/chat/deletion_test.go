@@ -166,10 +166,6 @@ func TestDeletionWithGroupChatMongo(t *testing.T) {
 	dataSubjectLocator := pal.Locator{
 		LocatorType: pal.Document,
 		DataType:    string(UserDataType),
-		FirestoreLocator: pal.FirestoreLocator{
-			CollectionPath: []string{FirestoreUsersCollection},
-			DocIDs:         []string{user1.ID},
-		},
 		MongoLocator: pal.MongoLocator{
 			Collection: "users",
 			Filter:     bson.D{{Key: "_id", Value: userID}},
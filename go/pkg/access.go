@@ -1,109 +1,432 @@
 package pal
 
 import (
+	"context"
 	"fmt"
+	"sort"
 )
 
-func (pal *Client) ProcessAccessRequest(handleAccess HandleAccessFunc, dataSubjectLocator Locator, dataSubjectID string) (map[string]interface{}, error) {
+// ReferenceKey is the only key of the object that stands in for a document
+// which already appears elsewhere in an access report, e.g.
+// {"$ref": "users/123"}. Its value identifies the document.
+//
+// Every document is expanded once per DataType and Context, at the first place
+// it is reached with them while the report is built, since HandleAccess may
+// return different data for each. Keys of the maps returned by HandleAccess are visited in
+// sorted order, and the documents of a collection in order of document ID,
+// so the same occurrence is expanded on every run. A locator
+// that leads back to a document being expanded with the same DataType, i.e. a
+// cycle, also yields a reference, whatever its Context, so that a Context that
+// changes on every hop does not make the traversal go around the cycle
+// forever.
+const ReferenceKey = "$ref"
+
+// accessRequest holds the state of a single access request traversal.
+type accessRequest struct {
+	backend       Backend
+	handleAccess  HandleAccessFunc
+	dataSubjectID string
+	// visited holds the handleKey of documents already expanded in the report
+	visited map[string]bool
+	// expanding holds the expansionKey of the documents being expanded, from
+	// the data subject down to the current document
+	expanding map[string]bool
+	limits    *limitTracker
+	// prefetcher is set if the request reads documents concurrently
+	prefetcher *prefetcher
+	// batched holds documents read together with their siblings that have
+	// not been expanded yet, keyed by locator key
+	batched map[string]LocatorAndObject
+	// errorPolicy selects what happens when a document cannot be read or
+	// handled, and failures holds the entries of ErrorsKey
+	errorPolicy ErrorPolicy
+	failures    []interface{}
+	// provenance is set if every document in the report carries ProvenanceKey
+	provenance bool
+}
+
+// ProcessAccessRequest builds the access report of a data subject. The request
+// itself has no deadline; the MongoDB backend bounds each of its reads by
+// MongoReadTimeout. Use ProcessAccessRequestWithContext to bound or cancel the
+// whole request.
+func (pal *Client) ProcessAccessRequest(handleAccess HandleAccessFunc, dataSubjectLocator Locator, dataSubjectID string, opts ...RequestOption) (map[string]interface{}, error) {
+	return pal.ProcessAccessRequestWithContext(context.Background(), handleAccess, dataSubjectLocator, dataSubjectID, opts...)
+}
+
+// ProcessAccessRequestWithContext is like ProcessAccessRequest, but every read
+// issued while traversing is bound to ctx. Cancelling ctx or letting its
+// deadline pass stops the traversal and returns the context's error.
+func (pal *Client) ProcessAccessRequestWithContext(ctx context.Context, handleAccess HandleAccessFunc, dataSubjectLocator Locator, dataSubjectID string, opts ...RequestOption) (map[string]interface{}, error) {
 	fmt.Printf("Processing access request for data subject %s\n", dataSubjectID)
 	if dataSubjectLocator.LocatorType != Document {
 		return nil, fmt.Errorf("%s data subject locator type must be document", ACCESS_REQUEST_ERROR)
 	}
-	locAndObj, err := pal.dbClient.getDocument(dataSubjectLocator)
+	dataSubjectLocator, err := resolveLocator(pal.backend, dataSubjectLocator)
 	if err != nil {
 		return nil, fmt.Errorf("%s %w", ACCESS_REQUEST_ERROR, err)
 	}
+	if err := checkLocators(pal.backend, []string{""}, []Locator{dataSubjectLocator}); err != nil {
+		return nil, fmt.Errorf("%s %w", ACCESS_REQUEST_ERROR, err)
+	}
+	options := newRequestOptions(opts)
+	req := &accessRequest{
+		backend:       pal.backend,
+		handleAccess:  resolvingAccessHandler(pal.backend, handleAccess),
+		dataSubjectID: dataSubjectID,
+		visited:       map[string]bool{handleKey(dataSubjectLocator): true},
+		expanding:     make(map[string]bool),
+		limits:        &limitTracker{limits: options.limits},
+		batched:       make(map[string]LocatorAndObject),
+		errorPolicy:   options.errorPolicy,
+		provenance:    options.provenance,
+	}
+	if options.concurrency > 1 {
+		req.prefetcher = newPrefetcher(ctx, req, options.concurrency, options.limits)
+		defer req.prefetcher.stop()
+	}
+
+	if _, err := req.limits.addDocuments(1, dataSubjectLocator); err != nil {
+		return nil, fmt.Errorf("%s %w", ACCESS_REQUEST_ERROR, traversalError(dataSubjectLocator, "", err))
+	}
+	locAndObj, err := pal.backend.GetDocument(ctx, dataSubjectLocator)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", ACCESS_REQUEST_ERROR, traversalError(dataSubjectLocator, "", err))
+	}
+
 	dataSubject := locAndObj.Object
-	data, err := pal.processAccessRequest(handleAccess, dataSubject, dataSubjectID, dataSubjectLocator)
+	data, err := req.processAccessRequest(ctx, dataSubject, dataSubjectLocator, 0, "")
 	if err != nil {
 		return nil, fmt.Errorf("%s %w", ACCESS_REQUEST_ERROR, err)
 	}
+	if len(req.failures) > 0 {
+		data[ErrorsKey] = req.failures
+	}
 
 	return data, nil
 }
 
-func (pal *Client) processAccessRequest(handleAccess HandleAccessFunc, dataNode DatabaseObject, dataSubjectID string, dataNodeLocator Locator) (map[string]interface{}, error) {
+// processAccessRequest returns the report for a document, found at path in
+// the report.
+func (req *accessRequest) processAccessRequest(ctx context.Context, dataNode DatabaseObject, dataNodeLocator Locator, depth int, path string) (map[string]interface{}, error) {
+
+	data, err := req.handle(dataNodeLocator, dataNode, depth)
+	if err != nil {
+		return nil, traversalError(dataNodeLocator, path, err)
+	}
+	return req.processData(ctx, data, dataNode, dataNodeLocator, depth, path)
+}
 
-	data, err := handleAccess(dataSubjectID, dataNodeLocator, dataNode)
+// processNode returns the report for a document reached through a locator, or
+// what the error policy puts in its place if HandleAccess fails on it.
+func (req *accessRequest) processNode(ctx context.Context, dataNode DatabaseObject, dataNodeLocator Locator, depth int, path string) (interface{}, error) {
+	data, err := req.handle(dataNodeLocator, dataNode, depth)
 	if err != nil {
+		return req.nodeFailed(dataNodeLocator, path, err)
+	}
+	return req.processData(ctx, data, dataNode, dataNodeLocator, depth, path)
+}
+
+// processData returns the report for the data HandleAccess returned for a
+// document.
+func (req *accessRequest) processData(ctx context.Context, data map[string]interface{}, dataNode DatabaseObject, dataNodeLocator Locator, depth int, path string) (map[string]interface{}, error) {
+	if err := req.checkLocators(data, path); err != nil {
 		return nil, err
 	}
+	req.expanding[expansionKey(dataNodeLocator)] = true
+	defer delete(req.expanding, expansionKey(dataNodeLocator))
 	report := make(map[string]interface{})
 
-	for key, value := range data {
+	for _, key := range sortedKeys(data) {
+		value := data[key]
 		if loc, ok := value.(Locator); ok {
 			// if locator, recursively process
-			retData, err := pal.processLocator(handleAccess, loc, dataSubjectID)
+			retData, err := req.processLocator(ctx, loc, depth+1, reportPath(path, key))
 			if err != nil {
 				return nil, err
 			}
+			if _, ok := retData.(skippedNode); ok {
+				continue
+			}
 			report[key] = retData
 		} else if locs, ok := value.([]Locator); ok {
 			// if locator slice, recursively process each locator
 			report[key] = make([]interface{}, 0)
-			for _, loc := range locs {
-				retData, err := pal.processLocator(handleAccess, loc, dataSubjectID)
+			req.readSiblings(ctx, locs, depth+1)
+			for i, loc := range locs {
+				retData, err := req.processLocator(ctx, loc, depth+1, indexPath(reportPath(path, key), i))
 				if err != nil {
 					return nil, err
 				}
+				if _, ok := retData.(skippedNode); ok {
+					continue
+				}
 				report[key] = append(report[key].([]interface{}), retData)
 			}
 		} else if locMap, ok := value.(map[string]Locator); ok {
 			// if map, recursively process each locator
 			report[key] = make(map[string]interface{})
-			for k, loc := range locMap {
-				retData, err := pal.processLocator(handleAccess, loc, dataSubjectID)
+			siblings := make([]Locator, 0, len(locMap))
+			for _, k := range sortedKeys(locMap) {
+				siblings = append(siblings, locMap[k])
+			}
+			req.readSiblings(ctx, siblings, depth+1)
+			for _, k := range sortedKeys(locMap) {
+				retData, err := req.processLocator(ctx, locMap[k], depth+1, reportPath(reportPath(path, key), k))
 				if err != nil {
 					return nil, err
 				}
+				if _, ok := retData.(skippedNode); ok {
+					continue
+				}
 				report[key].(map[string]interface{})[k] = retData
 			}
 		} else {
 			// else, directly add to report
+			if err := req.limits.addReportValue(key, value, dataNodeLocator); err != nil {
+				truncatedValue, err := req.limitReached(err, dataNodeLocator, reportPath(path, key))
+				if err != nil {
+					return nil, err
+				}
+				report[key] = truncatedValue
+				continue
+			}
 			report[key] = value
 		}
 	}
+	report[DataTypeKey] = dataNodeLocator.DataType
+	if req.provenance {
+		report[ProvenanceKey] = provenance(req.backend, dataNode, dataNodeLocator, path)
+	}
 
 	return report, nil
 }
 
-func (pal *Client) processLocator(handleAccess HandleAccessFunc, loc Locator, dataSubjectID string) (interface{}, error) {
-	err := validateLocator(loc)
-	if err != nil {
+// processLocator returns the report for the documents loc points to, found at
+// path in the report.
+func (req *accessRequest) processLocator(ctx context.Context, loc Locator, depth int, path string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 	if loc.LocatorType == Document {
-		locAndObj, err := pal.dbClient.getDocument(loc)
+		if req.visited[handleKey(loc)] || req.expanding[expansionKey(loc)] {
+			return reference(loc.key()), nil
+		}
+		if err := req.limits.checkDepth(depth, loc); err != nil {
+			return req.limitReached(err, loc, path)
+		}
+		if _, err := req.limits.addDocuments(1, loc); err != nil {
+			return req.limitReached(err, loc, path)
+		}
+		req.visited[handleKey(loc)] = true
+
+		locAndObj, err := req.getDocument(ctx, loc)
 		if err != nil {
-			return nil, err
+			return req.nodeFailed(loc, path, err)
 		}
 		dataNode := locAndObj.Object
-		retData, err := pal.processAccessRequest(handleAccess, dataNode, dataSubjectID, loc)
+		retData, err := req.processNode(ctx, dataNode, loc, depth, path)
 		if err != nil {
 			return nil, err
 		}
 		return retData, nil
 	} else if loc.LocatorType == Collection {
-		locAndObjs, err := pal.dbClient.getDocuments(loc)
+		if err := req.limits.checkDepth(depth, loc); err != nil {
+			return req.limitReached(err, loc, path)
+		}
+		locAndObjs, err := req.getDocuments(req.limits.fetchContext(ctx), loc)
 		if err != nil {
-			return nil, err
+			return req.nodeFailed(loc, path, err)
 		}
+		sortByKey(locAndObjs)
 
-		dataNodes := make([]DatabaseObject, 0)
-		for _, locAndObj := range locAndObjs {
-			dataNodes = append(dataNodes, locAndObj.Object)
+		var truncatedValue interface{}
+		allowed, limitErr := req.limits.addDocuments(len(locAndObjs), loc)
+		if limitErr != nil {
+			truncatedValue, err = req.limitReached(limitErr, loc, path)
+			if err != nil {
+				return nil, err
+			}
+			locAndObjs = locAndObjs[:allowed]
 		}
 
 		var retData []interface{}
-		for _, dataNode := range dataNodes {
-			currDataNodeData, err := pal.processAccessRequest(handleAccess, dataNode, dataSubjectID, loc)
+		for i, locAndObj := range locAndObjs {
+			if req.visited[handleKey(locAndObj.Locator)] || req.expanding[expansionKey(locAndObj.Locator)] {
+				retData = append(retData, reference(locAndObj.Locator.key()))
+				continue
+			}
+			req.visited[handleKey(locAndObj.Locator)] = true
+
+			currDataNodeData, err := req.processNode(ctx, locAndObj.Object, locAndObj.Locator, depth, indexPath(path, i))
 			if err != nil {
 				return nil, err
 			}
+			if _, ok := currDataNodeData.(skippedNode); ok {
+				continue
+			}
 			retData = append(retData, currDataNodeData)
 		}
+		if truncatedValue != nil {
+			// note that the documents that did not fit were left out
+			retData = append(retData, truncatedValue)
+		}
 		return retData, nil
 
 	}
-	return nil, fmt.Errorf("invalid locator type")
+	return nil, traversalError(loc, path, ErrInvalidLocator)
+}
+
+// expansionKey identifies a document and the DataType it is expanded as,
+// leaving out the Context.
+func expansionKey(loc Locator) string {
+	return loc.DataType + " " + loc.key()
+}
+
+// readSiblings reads the documents that the Document locators among locs,
+// found at depth, point to in one round trip if the backend is a
+// BatchBackend. getDocument then returns them without reading them again.
+// Only documents the traversal may still expand are read.
+func (req *accessRequest) readSiblings(ctx context.Context, locs []Locator, depth int) {
+	batch, ok := req.backend.(BatchBackend)
+	if !ok || req.prefetcher != nil {
+		return
+	}
+	if maxDepth := req.limits.limits.MaxDepth; maxDepth > 0 && depth > maxDepth {
+		return
+	}
+
+	toRead := make([]Locator, 0, len(locs))
+	seen := make(map[string]bool)
+	for _, loc := range locs {
+		if loc.LocatorType != Document {
+			continue
+		}
+		key := loc.key()
+		if _, ok := req.batched[key]; ok || req.visited[handleKey(loc)] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		toRead = append(toRead, loc)
+	}
+	if left, ok := req.limits.documentsLeft(); ok && len(toRead) > left {
+		toRead = toRead[:left]
+	}
+	if len(toRead) < 2 {
+		return
+	}
+
+	locAndObjs, err := batch.GetAll(ctx, toRead)
+	if err != nil {
+		// getDocument reads each document on its own and reports the error
+		// for the locator that caused it
+		return
+	}
+	for i, locAndObj := range locAndObjs {
+		req.batched[toRead[i].key()] = locAndObj
+	}
+}
+
+// checkLocators returns an *InvalidLocatorError if any of the locators in the
+// data a handler returned for the document at path cannot be read.
+func (req *accessRequest) checkLocators(data map[string]interface{}, path string) error {
+	var paths []string
+	var locs []Locator
+	for _, key := range sortedKeys(data) {
+		switch value := data[key].(type) {
+		case Locator:
+			paths = append(paths, reportPath(path, key))
+			locs = append(locs, value)
+		case []Locator:
+			for i, loc := range value {
+				paths = append(paths, indexPath(reportPath(path, key), i))
+				locs = append(locs, loc)
+			}
+		case map[string]Locator:
+			for _, k := range sortedKeys(value) {
+				paths = append(paths, reportPath(reportPath(path, key), k))
+				locs = append(locs, value[k])
+			}
+		}
+	}
+	return checkLocators(req.backend, paths, locs)
+}
+
+func (req *accessRequest) getDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	key := loc.key()
+	if locAndObj, ok := req.batched[key]; ok {
+		delete(req.batched, key)
+		loc.LocatorType = Document
+		return LocatorAndObject{Locator: loc, Object: locAndObj.Object}, nil
+	}
+	if req.prefetcher != nil {
+		return req.prefetcher.getDocument(ctx, loc)
+	}
+	return req.backend.GetDocument(ctx, loc)
+}
+
+func (req *accessRequest) getDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
+	if req.prefetcher == nil {
+		return req.backend.GetDocuments(ctx, loc)
+	}
+	locAndObjs, err := req.prefetcher.getDocuments(ctx, loc)
+	// the prefetcher may have read more documents than this point asks for
+	if limit := FetchLimit(ctx); limit > 0 && len(locAndObjs) > limit {
+		locAndObjs = locAndObjs[:limit]
+	}
+	return locAndObjs, err
+}
+
+func (req *accessRequest) handle(loc Locator, obj DatabaseObject, depth int) (map[string]interface{}, error) {
+	if req.prefetcher != nil {
+		return req.prefetcher.handle(loc, obj, depth)
+	}
+	return req.handleAccess(req.dataSubjectID, loc, obj)
+}
+
+// limitReached returns the note that replaces the part of the report at path
+// left out because of err, or err itself, hit while processing loc, if the
+// request fails on limits.
+func (req *accessRequest) limitReached(err error, loc Locator, path string) (interface{}, error) {
+	limitErr, ok := err.(*LimitError)
+	if !ok || req.limits.limits.OnLimit != TruncateOnLimit {
+		return nil, traversalError(loc, path, err)
+	}
+	return truncated(limitErr), nil
+}
+
+// sortByKey sorts the documents of a query result by locator key, i.e. by
+// document ID within a collection. Backends return them in their own order;
+// sorting makes the report, and which occurrence of a document is expanded,
+// the same on every run.
+func sortByKey(locAndObjs []LocatorAndObject) {
+	keys := make([]string, len(locAndObjs))
+	for i, locAndObj := range locAndObjs {
+		keys[i] = locAndObj.Locator.key()
+	}
+	sort.Stable(byKey{locAndObjs: locAndObjs, keys: keys})
+}
+
+type byKey struct {
+	locAndObjs []LocatorAndObject
+	keys       []string
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.locAndObjs[i], b.locAndObjs[j] = b.locAndObjs[j], b.locAndObjs[i]
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+}
+
+func reference(key string) map[string]interface{} {
+	return map[string]interface{}{ReferenceKey: key}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
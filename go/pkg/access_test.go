@@ -0,0 +1,381 @@
+package pal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// handleAccessFriends follows the "friends" and "chats" of every user, so that
+// the users in newFriendsBackend reach each other in a cycle and share a chat.
+func handleAccessFriends(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+	data := map[string]interface{}{}
+	switch currentDbObjLocator.DataType {
+	case "user":
+		data["Name"] = dbObj["name"]
+		friends := make(map[string]Locator)
+		for _, id := range dbObj["friends"].([]interface{}) {
+			friends[id.(string)] = Locator{
+				LocatorType:      Document,
+				DataType:         "user",
+				FirestoreLocator: FirestoreLocator{CollectionPath: []string{"users"}, DocIDs: []string{id.(string)}},
+			}
+		}
+		data["Friends"] = friends
+		data["Chats"] = Locator{
+			LocatorType:      Collection,
+			DataType:         "chat",
+			FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, Filters: []Filter{{Path: "users", Op: "array-contains", Value: dbObj["_id"]}}},
+		}
+	case "chat":
+		data["Title"] = dbObj["title"]
+	}
+	return data, nil
+}
+
+func newFriendsBackend(t *testing.T) *MemoryBackend {
+	backend := NewMemoryBackend(FirestoreStyle)
+	docs := map[string]map[string]interface{}{
+		"users/u1": {"name": "user1", "friends": []interface{}{"u2", "u3"}},
+		"users/u2": {"name": "user2", "friends": []interface{}{"u1", "u3"}},
+		"users/u3": {"name": "user3", "friends": []interface{}{}},
+		"chats/c1": {"title": "shared", "users": []interface{}{"u1", "u2"}},
+	}
+	for path, doc := range docs {
+		if err := backend.Put(path, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return backend
+}
+
+func TestAccessRequestCycles(t *testing.T) {
+	client := NewClient(newFriendsBackend(t))
+	subject := Locator{
+		LocatorType:      Document,
+		DataType:         "user",
+		FirestoreLocator: FirestoreLocator{CollectionPath: []string{"users"}, DocIDs: []string{"u1"}},
+	}
+
+	want := map[string]interface{}{
+		"Name": "user1",
+		"Chats": []interface{}{
+			map[string]interface{}{"Title": "shared", DataTypeKey: "chat"},
+		},
+		"Friends": map[string]interface{}{
+			"u2": map[string]interface{}{
+				"Name":  "user2",
+				"Chats": []interface{}{reference("chats/c1")},
+				"Friends": map[string]interface{}{
+					"u1": reference("users/u1"),
+					"u3": map[string]interface{}{
+						"Name":      "user3",
+						"Chats":     []interface{}(nil),
+						"Friends":   map[string]interface{}{},
+						DataTypeKey: "user",
+					},
+				},
+				DataTypeKey: "user",
+			},
+			"u3": reference("users/u3"),
+		},
+		DataTypeKey: "user",
+	}
+
+	var first []byte
+	for i := 0; i < 5; i++ {
+		report, err := client.ProcessAccessRequest(handleAccessFriends, subject, "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Fatalf("got report %v, want %v", report, want)
+		}
+
+		encoded, err := json.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = encoded
+		} else if string(encoded) != string(first) {
+			t.Fatalf("report changed between runs:\n%s\n%s", first, encoded)
+		}
+	}
+}
+
+// TestAccessRequestDataTypes reaches users/u2 both as a "profile" and as a
+// "friend": each DataType is expanded once, and only repeats are references.
+func TestAccessRequestDataTypes(t *testing.T) {
+	backend := NewMemoryBackend(FirestoreStyle)
+	for path, doc := range map[string]map[string]interface{}{
+		"users/u1": {"name": "user1"},
+		"users/u2": {"name": "user2", "bio": "hi"},
+	} {
+		if err := backend.Put(path, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handleAccess := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+		switch currentDbObjLocator.DataType {
+		case "user":
+			return map[string]interface{}{
+				"Name":    dbObj["name"],
+				"Profile": Ref("users", "u2").Locator("profile"),
+				"Friends": []Locator{Ref("users", "u2").Locator("friend"), Ref("users", "u2").Locator("friend")},
+			}, nil
+		case "profile":
+			return map[string]interface{}{"Bio": dbObj["bio"]}, nil
+		case "friend":
+			return map[string]interface{}{"Name": dbObj["name"]}, nil
+		}
+		return nil, fmt.Errorf("unexpected data type %s", currentDbObjLocator.DataType)
+	}
+
+	want := map[string]interface{}{
+		"Name":      "user1",
+		"Friends":   []interface{}{map[string]interface{}{"Name": "user2", DataTypeKey: "friend"}, reference("users/u2")},
+		"Profile":   map[string]interface{}{"Bio": "hi", DataTypeKey: "profile"},
+		DataTypeKey: "user",
+	}
+	for _, concurrency := range []int{1, 4} {
+		report, err := NewClient(backend).ProcessAccessRequest(handleAccess, Ref("users", "u1").Locator("user"), "u1", WithConcurrency(concurrency))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("concurrency %d: got report %v, want %v", concurrency, report, want)
+		}
+	}
+}
+
+func TestAccessRequestGrowingContext(t *testing.T) {
+	// every hop extends the Context with the path taken so far, so no two
+	// locators of the cycle between u1 and u2 have the same handleKey
+	handleAccess := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+		via, _ := currentDbObjLocator.Context.([]interface{})
+		via = append(append([]interface{}{}, via...), dbObj["_id"])
+		friends := make(map[string]Locator)
+		for _, id := range dbObj["friends"].([]interface{}) {
+			friend := Ref("users", id.(string)).Locator("user")
+			friend.Context = via
+			friends[id.(string)] = friend
+		}
+		return map[string]interface{}{"Name": dbObj["name"], "Friends": friends}, nil
+	}
+
+	u3 := map[string]interface{}{"Name": "user3", "Friends": map[string]interface{}{}, DataTypeKey: "user"}
+	want := map[string]interface{}{
+		"Name": "user1",
+		"Friends": map[string]interface{}{
+			"u2": map[string]interface{}{
+				"Name":      "user2",
+				"Friends":   map[string]interface{}{"u1": reference("users/u1"), "u3": u3},
+				DataTypeKey: "user",
+			},
+			"u3": u3,
+		},
+		DataTypeKey: "user",
+	}
+	for _, concurrency := range []int{1, 4} {
+		report, err := NewClient(newFriendsBackend(t)).ProcessAccessRequest(handleAccess, Ref("users", "u1").Locator("user"), "u1", WithConcurrency(concurrency))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("concurrency %d: got report %v, want %v", concurrency, report, want)
+		}
+	}
+}
+
+func TestAccessRequestCancel(t *testing.T) {
+	for _, concurrency := range []int{1, 4} {
+		ctx, cancel := context.WithCancel(context.Background())
+		// cancel the request once the traversal reaches the shared chat
+		handleAccess := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+			if currentDbObjLocator.DataType == "chat" {
+				cancel()
+			}
+			return handleAccessFriends(dataSubjectId, currentDbObjLocator, dbObj)
+		}
+		_, err := NewClient(newFriendsBackend(t)).ProcessAccessRequestWithContext(ctx, handleAccess, friendsSubject("u1"), "u1", WithConcurrency(concurrency))
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("concurrency %d: got error %v, want context.Canceled", concurrency, err)
+		}
+
+		expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		_, err = NewClient(newFriendsBackend(t)).ProcessAccessRequestWithContext(expired, handleAccessFriends, friendsSubject("u1"), "u1", WithConcurrency(concurrency))
+		cancelExpired()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("concurrency %d: got error %v, want context.DeadlineExceeded", concurrency, err)
+		}
+	}
+}
+
+// countingBackend counts the single document reads made through it. It hides
+// GetAll of the wrapped backend; batchCountingBackend exposes and counts it.
+type countingBackend struct {
+	Backend
+
+	mu        sync.Mutex
+	getOne    int
+	getAll    int
+	batchSize int
+}
+
+func (b *countingBackend) GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	b.mu.Lock()
+	b.getOne++
+	b.mu.Unlock()
+	return b.Backend.GetDocument(ctx, loc)
+}
+
+type batchCountingBackend struct {
+	*countingBackend
+}
+
+func (b batchCountingBackend) GetAll(ctx context.Context, locs []Locator) ([]LocatorAndObject, error) {
+	b.mu.Lock()
+	b.getAll++
+	b.batchSize += len(locs)
+	b.mu.Unlock()
+	return b.Backend.(BatchBackend).GetAll(ctx, locs)
+}
+
+func TestAccessRequestBatching(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []RequestOption
+	}{
+		{"serial", nil},
+		{"concurrent", []RequestOption{WithConcurrency(4)}},
+		{"max documents", []RequestOption{WithLimits(Limits{MaxDocuments: 10, OnLimit: TruncateOnLimit})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unbatched := &countingBackend{Backend: newGeneratedFriendsBackend(t, 20)}
+			want, err := NewClient(unbatched).ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			batched := batchCountingBackend{&countingBackend{Backend: newGeneratedFriendsBackend(t, 20)}}
+			got, err := NewClient(batched).ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("batched report differs from unbatched report:\ngot  %v\nwant %v", got, want)
+			}
+			if batched.getAll == 0 {
+				t.Fatalf("GetAll was not called")
+			}
+			// every friend is either read in a batch or read on its own
+			if batched.getOne+batched.batchSize < unbatched.getOne || batched.getOne >= unbatched.getOne {
+				t.Errorf("got %d single reads and %d batched documents, want fewer than %d single reads",
+					batched.getOne, batched.batchSize, unbatched.getOne)
+			}
+		})
+	}
+}
+
+func TestAccessRequestBatchingMissingDocument(t *testing.T) {
+	backend := newFriendsBackend(t)
+	if err := backend.Put("users/u3", map[string]interface{}{"name": "user3", "friends": []interface{}{"u1", "missing"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewClient(backend).ProcessAccessRequest(handleAccessFriends, friendsSubject("u3"), "u3")
+	if err == nil {
+		t.Fatal("expected an error for a friend that does not exist")
+	}
+}
+
+// handleAccessContext passes a Context to the friends and chats of the data
+// subject, and reports the Context each of them is reached with.
+func handleAccessContext(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+	if currentDbObjLocator.DataType == "chat" {
+		return map[string]interface{}{"Context": currentDbObjLocator.Context}, nil
+	}
+	if currentDbObjLocator.Context != nil {
+		return map[string]interface{}{"Via": currentDbObjLocator.Context.(map[string]interface{})["via"]}, nil
+	}
+	friends := make(map[string]Locator)
+	for _, id := range dbObj["friends"].([]interface{}) {
+		friends[id.(string)] = Locator{
+			LocatorType:      Document,
+			DataType:         "user",
+			FirestoreLocator: FirestoreLocator{CollectionPath: []string{"users"}, DocIDs: []string{id.(string)}},
+			Context:          map[string]interface{}{"via": dbObj["_id"]},
+		}
+	}
+	chats := Locator{
+		LocatorType:      Collection,
+		DataType:         "chat",
+		FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, Filters: []Filter{{Path: "users", Op: "array-contains", Value: dbObj["_id"]}}},
+		Context:          "member",
+	}
+	return map[string]interface{}{"Friends": friends, "Chats": chats}, nil
+}
+
+func TestLocatorContext(t *testing.T) {
+	want := map[string]interface{}{
+		"Friends": map[string]interface{}{
+			"u2": map[string]interface{}{"Via": "u1", DataTypeKey: "user"},
+			"u3": map[string]interface{}{"Via": "u1", DataTypeKey: "user"},
+		},
+		"Chats":     []interface{}{map[string]interface{}{"Context": "member", DataTypeKey: "chat"}},
+		DataTypeKey: "user",
+	}
+	tests := []struct {
+		name    string
+		backend Backend
+		opts    []RequestOption
+	}{
+		{"serial", &countingBackend{Backend: newFriendsBackend(t)}, nil},
+		{"batched", batchCountingBackend{&countingBackend{Backend: newFriendsBackend(t)}}, nil},
+		{"concurrent", newFriendsBackend(t), []RequestOption{WithConcurrency(4)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewClient(tt.backend).ProcessAccessRequest(handleAccessContext, friendsSubject("u1"), "u1", tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got report %v, want %v", got, want)
+			}
+		})
+	}
+
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		if currentDbObjLocator.DataType == "chat" {
+			if currentDbObjLocator.Context != "member" {
+				return nil, false, FieldUpdates{}, fmt.Errorf("got context %v, want member", currentDbObjLocator.Context)
+			}
+			return nil, false, FieldUpdates{Updates: []FieldUpdate{ArrayRemove("users", dataSubjectId)}}, nil
+		}
+		data, err := handleAccessContext(dataSubjectId, currentDbObjLocator, dbObj)
+		return []Locator{data["Chats"].(Locator)}, true, FieldUpdates{}, err
+	}
+	result, err := NewClient(newFriendsBackend(t)).ProcessDeletionRequest(handleDeletion, friendsSubject("u1"), "u1", false, WithDeletionPlan())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(result.Plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan DeletionPlan
+	if err := json.Unmarshal(encoded, &plan); err != nil {
+		t.Fatal(err)
+	}
+	if got := plan.DocumentsToUpdate[0].Locator.Context; got != "member" {
+		t.Errorf("got context %v in the decoded plan, want member", got)
+	}
+}
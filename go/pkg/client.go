@@ -12,13 +12,20 @@ type HandleAccessFunc func(dataSubjectId string, currentDbObjLocator Locator, db
 type HandleDeletionFunc func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (nodesToTraverse []Locator, deleteNode bool, fieldsToUpdate FieldUpdates, err error)
 
 type Client struct {
-	dbClient databaseClient
+	backend Backend
+}
+
+// NewClient returns a Client that reads and writes through the given Backend.
+// Use it to run requests against a data store that is not supported out of the
+// box; see Backend for the contract an implementation has to follow.
+func NewClient(backend Backend) *Client {
+	return &Client{backend: backend}
 }
 
 func NewClientWithFirestore(firestoreClient *firestore.Client) *Client {
-	return &Client{dbClient: newDbClientForFirestore(firestoreClient)}
+	return &Client{backend: newDbClientForFirestore(firestoreClient)}
 }
 
 func NewClientWithMongo(mongoDb *mongo.Database) *Client {
-	return &Client{dbClient: newDbClientForMongo(mongoDb)}
+	return &Client{backend: newDbClientForMongo(mongoDb)}
 }
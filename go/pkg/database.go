@@ -1,14 +1,107 @@
 package pal
 
-type databaseClient interface {
-	getDocument(loc Locator) (locatorAndObject, error)
-	getDocuments(loc Locator) ([]locatorAndObject, error)
-	updateAndDelete(documentsToUpdate []documentUpdates, nodesToDelete []Locator)
+import "context"
+
+// Backend is the storage layer a Client reads documents from and writes
+// deletions to. NewClientWithFirestore and NewClientWithMongo wrap the built-in
+// backends; other data stores can be supported by implementing Backend and
+// passing it to NewClient.
+//
+// Implementations must follow these rules so that handlers and the traversal
+// engine behave the same regardless of the store:
+//
+//   - GetDocument returns the single document located by a Document locator.
+//     The returned Locator is the input locator with LocatorType set to
+//     Document. If no document matches, an error is returned.
+//   - GetDocuments returns every document located by a Collection locator, in
+//     a stable order. Each returned Locator must be a Document locator that
+//     identifies exactly that document, so that it can later be passed back to
+//     GetDocument or UpdateAndDelete. DataType and Context are copied from
+//     the input. If FetchLimit(ctx) is positive, reading may stop after that
+//     many documents.
+//   - In both cases the DatabaseObject holds the document's fields, with the
+//     document ID added as a string under the "_id" key. Values should be
+//     plain Go values (maps, slices, strings, numbers, booleans, time.Time) so
+//     that handlers do not need to know which backend produced them.
+//   - UpdateAndDelete applies every update and deletion in one transaction
+//     where the store supports it, and returns an error if any of them could
+//     not be applied. If the store cannot apply them atomically, the error
+//     should be a *WriteError telling which of them were applied.
+type Backend interface {
+	GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error)
+	GetDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error)
+	UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error
+}
+
+// BatchBackend is implemented by backends that can read several documents in
+// one round trip. Access requests use it to read the Document locators a
+// handler returns together in a []Locator or map[string]Locator, instead of
+// reading them one at a time.
+//
+// GetAll returns the documents the Document locators in locs point to, in the
+// order of locs, following the same rules as GetDocument. If any document
+// does not exist or cannot be read, an error is returned; the caller then
+// reads the documents one at a time to tell which one failed.
+type BatchBackend interface {
+	Backend
+	GetAll(ctx context.Context, locs []Locator) ([]LocatorAndObject, error)
+}
+
+// ConditionalBackend is implemented by backends that can refuse to write to
+// documents that changed after they were read. ApplyDeletionPlan uses it to
+// make sure a plan is only applied to the documents it was built from.
+//
+// Fingerprint returns a string identifying the current version of the document
+// loc points to, such as its update time, and wraps ErrDocumentNotFound if
+// there is none. The documents GetDocument, GetDocuments and GetAll return
+// carry the fingerprint of the version they read in
+// LocatorAndObject.Fingerprint, so that deletion plans record the version
+// their handler saw. UpdateAndDeleteIfUnchanged is like
+// UpdateAndDelete, but applies nothing and returns a *StaleDocumentError if the
+// fingerprint of any document it writes, as found in fingerprints under the
+// key of its locator, no longer matches the document in the store.
+type ConditionalBackend interface {
+	Backend
+	Fingerprint(ctx context.Context, loc Locator) (string, error)
+	UpdateAndDeleteIfUnchanged(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator, fingerprints map[string]string) error
+}
+
+// ReferenceResolver is implemented by backends that support locators built
+// from a Reference. Requests resolve such locators as soon as a handler
+// returns them. ResolveReference returns loc with loc.Ref turned into the
+// backend's native locator and Ref cleared.
+type ReferenceResolver interface {
+	Backend
+	ResolveReference(loc Locator) (Locator, error)
+}
+
+// LocatorValidator is implemented by backends that check locators before
+// reading them. Requests call ValidateLocator on the data subject locator and
+// on every locator a handler returns, before any of them is read, and fail
+// with an *InvalidLocatorError if it returns problems. ValidateLocator returns
+// a description of every problem that keeps the backend from reading loc, or
+// nil if there is none.
+type LocatorValidator interface {
+	Backend
+	ValidateLocator(loc Locator) []string
+}
+
+// NamedBackend is implemented by backends that can tell which data store they
+// are, such as "firestore" or "mongodb". Access requests made WithProvenance
+// record the name of the backend of every document, or "unknown" if the
+// backend does not implement NamedBackend.
+type NamedBackend interface {
+	Backend
+	Name() string
 }
 
 type DatabaseObject map[string]interface{}
 
-type locatorAndObject struct {
+type LocatorAndObject struct {
 	Locator Locator
 	Object  DatabaseObject
+	// Fingerprint identifies the version of the document that was read, as
+	// returned by ConditionalBackend.Fingerprint. It is empty if the backend
+	// is not a ConditionalBackend.
+	Fingerprint string
 }
@@ -1,76 +1,298 @@
 package pal
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
 
-type documentUpdates struct {
+type DocumentUpdates struct {
 	Locator        Locator
 	FieldsToUpdate FieldUpdates
 }
 
+// FieldUpdates lists the changes to make to a document that is not deleted.
+// Updates are understood by every backend; FirestoreUpdates and MongoUpdates
+// are only applied by the Firestore and MongoDB backends respectively, after
+// them. MongoUpdates holds update documents such as
+// bson.D{{"$pull", bson.D{{"users", id}}}}, each applied in turn.
 type FieldUpdates struct {
+	Updates          []FieldUpdate
 	FirestoreUpdates []firestore.Update
 	MongoUpdates     []interface{}
 }
 
-func (pal *Client) ProcessDeletionRequest(handleDeletion HandleDeletionFunc, dataSubjectLocator Locator, dataSubjectID string, writeToDatabase bool) (string, error) {
-	documentsToUpdate, nodesToDelete, err := pal.processDeletionRequest(handleDeletion, dataSubjectLocator, dataSubjectID)
+// deletionRequest holds the state of a single deletion request traversal.
+type deletionRequest struct {
+	backend        Backend
+	handleDeletion HandleDeletionFunc
+	dataSubjectID  string
+	limits         *limitTracker
+	// fingerprints holds the fingerprint of every document as the handler
+	// saw it, keyed by the key of its locator, if a DeletionPlan is made.
+	fingerprints map[string]string
+}
+
+// ProcessDeletionRequest deletes the data of a data subject, or only plans the
+// deletion if writeToDatabase is false. The request itself has no deadline;
+// the MongoDB backend bounds each of its reads by MongoReadTimeout. Use
+// ProcessDeletionRequestWithContext to bound or cancel the whole request.
+func (pal *Client) ProcessDeletionRequest(handleDeletion HandleDeletionFunc, dataSubjectLocator Locator, dataSubjectID string, writeToDatabase bool, opts ...RequestOption) (*DeletionResult, error) {
+	return pal.ProcessDeletionRequestWithContext(context.Background(), handleDeletion, dataSubjectLocator, dataSubjectID, writeToDatabase, opts...)
+}
+
+// ProcessDeletionRequestWithContext is like ProcessDeletionRequest, but the
+// reads issued while building the deletion plan and the write transaction that
+// applies it are bound to ctx.
+//
+// If the plan cannot be built, the result is nil. If it is built but cannot be
+// written, both the result, with Outcome set to DeletionFailed, and the error
+// are returned.
+func (pal *Client) ProcessDeletionRequestWithContext(ctx context.Context, handleDeletion HandleDeletionFunc, dataSubjectLocator Locator, dataSubjectID string, writeToDatabase bool, opts ...RequestOption) (*DeletionResult, error) {
+	dataSubjectLocator, err := resolveLocator(pal.backend, dataSubjectLocator)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%s %w", DELETION_REQUEST_ERROR, err)
 	}
-	if writeToDatabase {
-		pal.dbClient.updateAndDelete(documentsToUpdate, nodesToDelete)
+	if err := checkLocators(pal.backend, []string{""}, []Locator{dataSubjectLocator}); err != nil {
+		return nil, fmt.Errorf("%s %w", DELETION_REQUEST_ERROR, err)
+	}
+	options := newRequestOptions(opts)
+	req := &deletionRequest{
+		backend:        pal.backend,
+		handleDeletion: resolvingDeletionHandler(pal.backend, handleDeletion),
+		dataSubjectID:  dataSubjectID,
+		limits:         &limitTracker{limits: options.limits},
+	}
+	if options.plan {
+		req.fingerprints = make(map[string]string)
 	}
 
-	result, err := json.Marshal(map[string]interface{}{
-		"writeToDatabase":   writeToDatabase,
-		"nodesToDelete":     nodesToDelete,
-		"documentsToUpdate": documentsToUpdate,
-	})
+	startedAt := time.Now()
+	documentsToUpdate, nodesToDelete, err := req.processDeletionRequest(ctx, dataSubjectLocator, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	documentsToUpdate, nodesToDelete, err = normalizePlan(documentsToUpdate, nodesToDelete)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	result := newDeletionResult(dataSubjectID, writeToDatabase, documentsToUpdate, nodesToDelete)
+	result.StartedAt = startedAt
+	result.PlanDuration = time.Since(startedAt)
+	result.BatchSize = options.batchSize
+	if options.preview {
+		result.Preview, err = previewPlan(ctx, pal.backend, documentsToUpdate, nodesToDelete)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.plan {
+		result.Plan, err = newDeletionPlan(ctx, pal.backend, dataSubjectID, documentsToUpdate, nodesToDelete, req.fingerprints)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !writeToDatabase {
+		return result, nil
 	}
-	return string(result), nil
+
+	return result, pal.writePlan(ctx, result)
+}
+
+// ApplyDeletionPlan writes a plan made by ProcessDeletionRequest with
+// WithDeletionPlan, typically after it has been reviewed and approved. If any
+// document the plan deletes or updates changed since the plan was made,
+// nothing is written and the error wraps a *StaleDocumentError.
+//
+// With a ConditionalBackend, such as the Firestore and MongoDB backends, the
+// check and the writes happen in one transaction. With other backends the
+// documents are read and compared before writing, which leaves a short window
+// in which changes go unnoticed. WithBatchSize applies to the plan as it does
+// to ProcessDeletionRequest; each batch is checked when it is written.
+func (pal *Client) ApplyDeletionPlan(ctx context.Context, plan *DeletionPlan, opts ...RequestOption) (*DeletionResult, error) {
+	if plan == nil {
+		return nil, fmt.Errorf("%s no deletion plan to apply", DELETION_REQUEST_ERROR)
+	}
+	if plan.Version != DeletionPlanVersion {
+		return nil, fmt.Errorf("%s unsupported deletion plan version %d", DELETION_REQUEST_ERROR, plan.Version)
+	}
+	options := newRequestOptions(opts)
+	result := newDeletionResult(plan.DataSubjectID, true, plan.DocumentsToUpdate, plan.NodesToDelete)
+	result.StartedAt = time.Now()
+	result.BatchSize = options.batchSize
+	result.Plan = plan
+	return result, pal.writePlan(ctx, result)
+}
+
+// ResumeDeletionRequest writes the part of a deletion plan that has not been
+// committed yet, e.g. after ProcessDeletionRequest failed part way through a
+// plan written in batches (see WithBatchSize). It starts after the last
+// committed batch, uses the batch size recorded in result, and updates result
+// as ProcessDeletionRequest would have. result may have been stored as JSON
+// and read back. The plan is not rebuilt, as the documents deleted by the
+// committed batches can no longer be read. If result
+// holds a DeletionPlan, the remaining documents are checked against it as
+// ApplyDeletionPlan does.
+func (pal *Client) ResumeDeletionRequest(ctx context.Context, result *DeletionResult) error {
+	if result.Outcome == DeletionApplied {
+		return fmt.Errorf("%s deletion has already been applied", DELETION_REQUEST_ERROR)
+	}
+	result.WriteToDatabase = true
+	result.Error = ""
+	return pal.writePlan(ctx, result)
 }
 
-func (pal *Client) processDeletionRequest(
-	handleDeletion HandleDeletionFunc,
+// writePlan writes the plan in result, in batches of result.BatchSize writes
+// if it is set, starting after the writes already committed. Deletions come
+// before updates, in the order of the plan. result records each committed
+// batch, so that a failed run can be resumed. If result holds a DeletionPlan,
+// documents that changed since it was made are not written.
+func (pal *Client) writePlan(ctx context.Context, result *DeletionResult) error {
+	write := pal.backend.UpdateAndDelete
+	if result.Plan != nil {
+		write = pal.conditionalWrite(result.Plan.Fingerprints)
+	}
+
+	total := result.writeCount()
+	batchSize := result.BatchSize
+	if batchSize <= 0 {
+		batchSize = total
+	}
+
+	writeStartedAt := time.Now()
+	defer func() {
+		result.WriteDuration += time.Since(writeStartedAt)
+	}()
+	for result.CommittedWrites < total {
+		start := result.CommittedWrites
+		end := start + batchSize
+		if end > total {
+			end = total
+		}
+		documentsToUpdate, nodesToDelete := result.batch(start, end)
+		if err := write(ctx, documentsToUpdate, nodesToDelete); err != nil {
+			// a batch is written in one transaction, so earlier batches stay
+			// applied and later ones were never attempted
+			batchErr := writeError(err, documentsToUpdate, nodesToDelete)
+			err = fmt.Errorf("%s %w", DELETION_REQUEST_ERROR, &WriteError{
+				Applied:    append(result.locators(0, start), batchErr.Applied...),
+				NotApplied: append(append([]Locator{}, batchErr.NotApplied...), result.locators(end, total)...),
+				Err:        batchErr.Err,
+			})
+			result.Outcome = DeletionFailed
+			result.Error = err.Error()
+			return err
+		}
+		result.CommittedWrites = end
+	}
+	result.Outcome = DeletionApplied
+	return nil
+}
+
+// conditionalWrite returns a function that writes to the backend unless a
+// document changed since its fingerprint was taken.
+func (pal *Client) conditionalWrite(fingerprints map[string]string) func(context.Context, []DocumentUpdates, []Locator) error {
+	if backend, ok := pal.backend.(ConditionalBackend); ok {
+		return func(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+			return backend.UpdateAndDeleteIfUnchanged(ctx, documentsToUpdate, nodesToDelete, fingerprints)
+		}
+	}
+	return func(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+		var stale []Locator
+		for _, loc := range writeLocators(documentsToUpdate, nodesToDelete) {
+			fingerprint, err := documentFingerprint(ctx, pal.backend, loc)
+			if err != nil || fingerprint != fingerprints[loc.key()] {
+				stale = append(stale, loc)
+			}
+		}
+		if len(stale) > 0 {
+			return &StaleDocumentError{Locators: stale}
+		}
+		return pal.backend.UpdateAndDelete(ctx, documentsToUpdate, nodesToDelete)
+	}
+}
+
+// writeError returns err as a *WriteError. Unless the backend says otherwise,
+// a failed write is assumed to have applied nothing, as the built-in backends
+// write in a single transaction.
+func writeError(err error, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) *WriteError {
+	var writeErr *WriteError
+	if errors.As(err, &writeErr) {
+		return writeErr
+	}
+	return &WriteError{NotApplied: writeLocators(documentsToUpdate, nodesToDelete), Err: err}
+}
+
+// processDeletionRequest returns the plan for the documents locator points
+// to, where path is the path through nodesToTraverse that led to locator.
+func (req *deletionRequest) processDeletionRequest(
+	ctx context.Context,
 	locator Locator,
-	dataSubjectID string,
-) (documentsToUpdate []documentUpdates, nodesToDelete []Locator, err error) {
-	dataNodes := make([]locatorAndObject, 0)
+	depth int,
+	path string,
+) (documentsToUpdate []DocumentUpdates, nodesToDelete []Locator, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	// a partial deletion plan would leave data behind, so limits always fail
+	if err := req.limits.checkDepth(depth, locator); err != nil {
+		return nil, nil, traversalError(locator, path, err)
+	}
+
+	dataNodes := make([]LocatorAndObject, 0)
 	if locator.LocatorType == Document {
-		node, err := pal.dbClient.getDocument(locator)
+		if _, err := req.limits.addDocuments(1, locator); err != nil {
+			return nil, nil, traversalError(locator, path, err)
+		}
+		node, err := req.backend.GetDocument(ctx, locator)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, traversalError(locator, path, err)
 		}
 		dataNodes = append(dataNodes, node)
 	} else {
-		nodes, err := pal.dbClient.getDocuments(locator)
+		nodes, err := req.backend.GetDocuments(req.limits.fetchContext(ctx), locator)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, traversalError(locator, path, err)
+		}
+		if _, err := req.limits.addDocuments(len(nodes), locator); err != nil {
+			return nil, nil, traversalError(locator, path, err)
 		}
 		dataNodes = append(dataNodes, nodes...)
 	}
 
-	allDocumentsToUpdate := make([]documentUpdates, 0)
+	allDocumentsToUpdate := make([]DocumentUpdates, 0)
 	allNodesToDelete := make([]Locator, 0)
-	for _, currNode := range dataNodes {
+	for i, currNode := range dataNodes {
 		currLocator := currNode.Locator
 		currObject := currNode.Object
+		currPath := path
+		if locator.LocatorType == Collection {
+			currPath = indexPath(path, i)
+		}
+		// before the handler gets a chance to change the object
+		if err := req.recordFingerprint(currNode); err != nil {
+			return nil, nil, traversalError(currLocator, currPath, err)
+		}
 
-		nodesToTraverse, deleteNode, fieldsToUpdate, err := handleDeletion(dataSubjectID, currLocator, currObject)
+		nodesToTraverse, deleteNode, fieldsToUpdate, err := req.handleDeletion(req.dataSubjectID, currLocator, currObject)
 		if err != nil {
+			return nil, nil, traversalError(currLocator, currPath, err)
+		}
+		nodePaths := make([]string, len(nodesToTraverse))
+		for j := range nodesToTraverse {
+			nodePaths[j] = indexPath(reportPath(currPath, "nodesToTraverse"), j)
+		}
+		if err := checkLocators(req.backend, nodePaths, nodesToTraverse); err != nil {
 			return nil, nil, err
 		}
 
 		// 1. first recursively process nested nodes
 		if len(nodesToTraverse) > 0 {
-			for _, nodeLocator := range nodesToTraverse {
-				documentsToUpdate, nodesToDelete, err := pal.processDeletionRequest(handleDeletion, nodeLocator, dataSubjectID)
+			for j, nodeLocator := range nodesToTraverse {
+				documentsToUpdate, nodesToDelete, err := req.processDeletionRequest(ctx, nodeLocator, depth+1, nodePaths[j])
 				if err != nil {
 					return nil, nil, err
 				}
@@ -83,9 +305,28 @@ func (pal *Client) processDeletionRequest(
 		if deleteNode {
 			allNodesToDelete = append(allNodesToDelete, currLocator)
 		} else {
-			allDocumentsToUpdate = append(allDocumentsToUpdate, documentUpdates{Locator: currLocator, FieldsToUpdate: fieldsToUpdate})
+			allDocumentsToUpdate = append(allDocumentsToUpdate, DocumentUpdates{Locator: currLocator, FieldsToUpdate: fieldsToUpdate})
 		}
 	}
 
 	return allDocumentsToUpdate, allNodesToDelete, nil
 }
+
+// recordFingerprint records the fingerprint of node, unless no plan is made or
+// the document was already read along another path.
+func (req *deletionRequest) recordFingerprint(node LocatorAndObject) error {
+	key := node.Locator.key()
+	if req.fingerprints == nil || req.fingerprints[key] != "" {
+		return nil
+	}
+	fingerprint := node.Fingerprint
+	if _, ok := req.backend.(ConditionalBackend); !ok {
+		// conditionalWrite compares the hash of the content instead
+		var err error
+		if fingerprint, err = documentHash(node.Object); err != nil {
+			return err
+		}
+	}
+	req.fingerprints[key] = fingerprint
+	return nil
+}
@@ -0,0 +1,467 @@
+package pal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DeletionPlanVersion is the version of the DeletionPlan format written by
+// this package. ApplyDeletionPlan refuses plans of other versions.
+const DeletionPlanVersion = 1
+
+// DeletionPlan is the set of writes a deletion request makes, in a form that
+// can be stored as JSON, reviewed, and applied later with ApplyDeletionPlan.
+//
+// Values are encoded as MongoDB Extended JSON, so that types such as ObjectIDs,
+// dates and 64-bit integers survive the round trip. Firestore updates may use
+// plain values, firestore.Delete and firestore.ServerTimestamp; other field
+// transforms, such as firestore.ArrayRemove, cannot be encoded, so use
+// FieldUpdates.Updates for them instead.
+type DeletionPlan struct {
+	Version           int
+	DataSubjectID     string
+	CreatedAt         time.Time
+	NodesToDelete     []Locator
+	DocumentsToUpdate []DocumentUpdates
+	// Fingerprints identifies the version of each document as it was when the
+	// plan was made, keyed by the key of its locator. See ConditionalBackend.
+	Fingerprints map[string]string
+}
+
+// newDeletionPlan builds a plan with the fingerprints recorded while the
+// documents were read for the handler. Documents without one, such as those of
+// a ConditionalBackend that does not fill in LocatorAndObject.Fingerprint, are
+// fingerprinted again.
+func newDeletionPlan(ctx context.Context, backend Backend, dataSubjectID string, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator, fingerprints map[string]string) (*DeletionPlan, error) {
+	plan := &DeletionPlan{
+		Version:           DeletionPlanVersion,
+		DataSubjectID:     dataSubjectID,
+		CreatedAt:         time.Now().UTC(),
+		NodesToDelete:     nodesToDelete,
+		DocumentsToUpdate: documentsToUpdate,
+		Fingerprints:      make(map[string]string),
+	}
+	for _, loc := range writeLocators(documentsToUpdate, nodesToDelete) {
+		fingerprint := fingerprints[loc.key()]
+		if fingerprint == "" {
+			var err error
+			if fingerprint, err = documentFingerprint(ctx, backend, loc); err != nil {
+				return nil, err
+			}
+		}
+		plan.Fingerprints[loc.key()] = fingerprint
+	}
+	return plan, nil
+}
+
+// documentFingerprint returns the fingerprint the backend gives the document
+// loc points to, or a hash of its content if the backend is not a
+// ConditionalBackend.
+func documentFingerprint(ctx context.Context, backend Backend, loc Locator) (string, error) {
+	if conditional, ok := backend.(ConditionalBackend); ok {
+		return conditional.Fingerprint(ctx, loc)
+	}
+	locAndObj, err := backend.GetDocument(ctx, loc)
+	if err != nil {
+		return "", err
+	}
+	return documentHash(locAndObj.Object)
+}
+
+// deletionPlanJSON is the JSON form of a DeletionPlan.
+type deletionPlanJSON struct {
+	Version           int                   `json:"version"`
+	DataSubjectID     string                `json:"dataSubjectId"`
+	CreatedAt         time.Time             `json:"createdAt"`
+	NodesToDelete     []locatorJSON         `json:"nodesToDelete"`
+	DocumentsToUpdate []documentUpdatesJSON `json:"documentsToUpdate"`
+	Fingerprints      map[string]string     `json:"fingerprints"`
+}
+
+type locatorJSON struct {
+	LocatorType    LocatorType     `json:"locatorType"`
+	DataType       string          `json:"dataType"`
+	CollectionPath []string        `json:"collectionPath,omitempty"`
+	DocIDs         []string        `json:"docIds,omitempty"`
+	Filters        []filterJSON    `json:"filters,omitempty"`
+	Collection     string          `json:"collection,omitempty"`
+	Filter         json.RawMessage `json:"filter,omitempty"`
+	Where          []filterJSON    `json:"where,omitempty"`
+	Context        json.RawMessage `json:"context,omitempty"`
+}
+
+type filterJSON struct {
+	Path  string          `json:"path"`
+	Op    string          `json:"op"`
+	Value json.RawMessage `json:"value"`
+}
+
+type documentUpdatesJSON struct {
+	Locator          locatorJSON           `json:"locator"`
+	Updates          []fieldUpdateJSON     `json:"updates,omitempty"`
+	FirestoreUpdates []firestoreUpdateJSON `json:"firestoreUpdates,omitempty"`
+	MongoUpdates     []json.RawMessage     `json:"mongoUpdates,omitempty"`
+}
+
+type fieldUpdateJSON struct {
+	Op     UpdateOp        `json:"op"`
+	Path   string          `json:"path"`
+	Key    string          `json:"key,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Values json.RawMessage `json:"values,omitempty"`
+}
+
+type firestoreUpdateJSON struct {
+	Path      string   `json:"path,omitempty"`
+	FieldPath []string `json:"fieldPath,omitempty"`
+	// Transform is empty for plain values, and otherwise "delete" or
+	// "serverTimestamp".
+	Transform string          `json:"transform,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+func (p DeletionPlan) MarshalJSON() ([]byte, error) {
+	encoded := deletionPlanJSON{
+		Version:       p.Version,
+		DataSubjectID: p.DataSubjectID,
+		CreatedAt:     p.CreatedAt,
+		Fingerprints:  p.Fingerprints,
+	}
+	var err error
+	encoded.DocumentsToUpdate, encoded.NodesToDelete, err = encodeWrites(p.DocumentsToUpdate, p.NodesToDelete)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded)
+}
+
+func (p *DeletionPlan) UnmarshalJSON(data []byte) error {
+	var encoded deletionPlanJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	if encoded.Version != DeletionPlanVersion {
+		return fmt.Errorf("unsupported deletion plan version %d", encoded.Version)
+	}
+
+	plan := DeletionPlan{
+		Version:       encoded.Version,
+		DataSubjectID: encoded.DataSubjectID,
+		CreatedAt:     encoded.CreatedAt,
+		Fingerprints:  encoded.Fingerprints,
+	}
+	var err error
+	plan.DocumentsToUpdate, plan.NodesToDelete, err = decodeWrites(encoded.DocumentsToUpdate, encoded.NodesToDelete)
+	if err != nil {
+		return err
+	}
+	*p = plan
+	return nil
+}
+
+// encodeWrites returns the JSON form of the updates and deletions of a plan.
+func encodeWrites(documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) ([]documentUpdatesJSON, []locatorJSON, error) {
+	encodedUpdates := make([]documentUpdatesJSON, len(documentsToUpdate))
+	encodedDeletes := make([]locatorJSON, len(nodesToDelete))
+	var err error
+	for i, loc := range nodesToDelete {
+		if encodedDeletes[i], err = encodeLocator(loc); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i, update := range documentsToUpdate {
+		if encodedUpdates[i], err = encodeDocumentUpdates(update); err != nil {
+			return nil, nil, err
+		}
+	}
+	return encodedUpdates, encodedDeletes, nil
+}
+
+// decodeWrites is the inverse of encodeWrites.
+func decodeWrites(encodedUpdates []documentUpdatesJSON, encodedDeletes []locatorJSON) ([]DocumentUpdates, []Locator, error) {
+	documentsToUpdate := make([]DocumentUpdates, len(encodedUpdates))
+	nodesToDelete := make([]Locator, len(encodedDeletes))
+	var err error
+	for i, loc := range encodedDeletes {
+		if nodesToDelete[i], err = decodeLocator(loc); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i, update := range encodedUpdates {
+		if documentsToUpdate[i], err = decodeDocumentUpdates(update); err != nil {
+			return nil, nil, err
+		}
+	}
+	return documentsToUpdate, nodesToDelete, nil
+}
+
+func encodeLocator(loc Locator) (locatorJSON, error) {
+	encoded := locatorJSON{
+		LocatorType:    loc.LocatorType,
+		DataType:       loc.DataType,
+		CollectionPath: loc.FirestoreLocator.CollectionPath,
+		DocIDs:         loc.DocIDs,
+		Collection:     loc.MongoLocator.Collection,
+	}
+	var err error
+	if encoded.Filters, err = encodeFilters(loc.Filters); err != nil {
+		return locatorJSON{}, fmt.Errorf("%s: %w", loc.key(), err)
+	}
+	if encoded.Where, err = encodeFilters(loc.MongoLocator.Where); err != nil {
+		return locatorJSON{}, fmt.Errorf("%s: %w", loc.key(), err)
+	}
+	if loc.Context != nil {
+		if encoded.Context, err = encodeValue(loc.Context); err != nil {
+			return locatorJSON{}, fmt.Errorf("context of %s: %w", loc.key(), err)
+		}
+	}
+	if loc.MongoLocator.Filter != nil {
+		filter, err := bson.MarshalExtJSON(loc.MongoLocator.Filter, true, false)
+		if err != nil {
+			return locatorJSON{}, fmt.Errorf("filter of %s: %w", loc.key(), err)
+		}
+		encoded.Filter = filter
+	}
+	return encoded, nil
+}
+
+func decodeLocator(encoded locatorJSON) (Locator, error) {
+	loc := Locator{
+		LocatorType: encoded.LocatorType,
+		DataType:    encoded.DataType,
+		FirestoreLocator: FirestoreLocator{
+			CollectionPath: encoded.CollectionPath,
+			DocIDs:         encoded.DocIDs,
+		},
+		MongoLocator: MongoLocator{Collection: encoded.Collection},
+	}
+	var err error
+	if loc.Filters, err = decodeFilters(encoded.Filters); err != nil {
+		return Locator{}, err
+	}
+	if loc.MongoLocator.Where, err = decodeFilters(encoded.Where); err != nil {
+		return Locator{}, err
+	}
+	if len(encoded.Context) > 0 {
+		if loc.Context, err = decodeValue(encoded.Context); err != nil {
+			return Locator{}, err
+		}
+	}
+	if len(encoded.Filter) > 0 {
+		if err := bson.UnmarshalExtJSON(encoded.Filter, true, &loc.MongoLocator.Filter); err != nil {
+			return Locator{}, err
+		}
+	}
+	return loc, nil
+}
+
+func encodeFilters(filters []Filter) ([]filterJSON, error) {
+	var encoded []filterJSON
+	for _, filter := range filters {
+		value, err := encodeValue(filter.Value)
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %w", filter.Path, err)
+		}
+		encoded = append(encoded, filterJSON{Path: filter.Path, Op: filter.Op, Value: value})
+	}
+	return encoded, nil
+}
+
+func decodeFilters(encoded []filterJSON) ([]Filter, error) {
+	var filters []Filter
+	for _, filter := range encoded {
+		value, err := decodeValue(filter.Value)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, Filter{Path: filter.Path, Op: filter.Op, Value: value})
+	}
+	return filters, nil
+}
+
+func encodeDocumentUpdates(update DocumentUpdates) (documentUpdatesJSON, error) {
+	loc, err := encodeLocator(update.Locator)
+	if err != nil {
+		return documentUpdatesJSON{}, err
+	}
+	encoded := documentUpdatesJSON{Locator: loc}
+	for _, fieldUpdate := range update.FieldsToUpdate.Updates {
+		encodedUpdate, err := encodeFieldUpdate(fieldUpdate)
+		if err != nil {
+			return documentUpdatesJSON{}, fmt.Errorf("update of %s: %w", update.Locator.key(), err)
+		}
+		encoded.Updates = append(encoded.Updates, encodedUpdate)
+	}
+	for _, firestoreUpdate := range update.FieldsToUpdate.FirestoreUpdates {
+		encodedUpdate, err := encodeFirestoreUpdate(firestoreUpdate)
+		if err != nil {
+			return documentUpdatesJSON{}, fmt.Errorf("update of %s: %w", update.Locator.key(), err)
+		}
+		encoded.FirestoreUpdates = append(encoded.FirestoreUpdates, encodedUpdate)
+	}
+	for _, mongoUpdate := range update.FieldsToUpdate.MongoUpdates {
+		encodedUpdate, err := bson.MarshalExtJSON(mongoUpdate, true, false)
+		if err != nil {
+			return documentUpdatesJSON{}, fmt.Errorf("update of %s: %w", update.Locator.key(), err)
+		}
+		encoded.MongoUpdates = append(encoded.MongoUpdates, encodedUpdate)
+	}
+	return encoded, nil
+}
+
+func decodeDocumentUpdates(encoded documentUpdatesJSON) (DocumentUpdates, error) {
+	loc, err := decodeLocator(encoded.Locator)
+	if err != nil {
+		return DocumentUpdates{}, err
+	}
+	update := DocumentUpdates{Locator: loc}
+	for _, encodedUpdate := range encoded.Updates {
+		fieldUpdate, err := decodeFieldUpdate(encodedUpdate)
+		if err != nil {
+			return DocumentUpdates{}, err
+		}
+		update.FieldsToUpdate.Updates = append(update.FieldsToUpdate.Updates, fieldUpdate)
+	}
+	for _, encodedUpdate := range encoded.FirestoreUpdates {
+		firestoreUpdate, err := decodeFirestoreUpdate(encodedUpdate)
+		if err != nil {
+			return DocumentUpdates{}, err
+		}
+		update.FieldsToUpdate.FirestoreUpdates = append(update.FieldsToUpdate.FirestoreUpdates, firestoreUpdate)
+	}
+	for _, encodedUpdate := range encoded.MongoUpdates {
+		var mongoUpdate bson.D
+		if err := bson.UnmarshalExtJSON(encodedUpdate, true, &mongoUpdate); err != nil {
+			return DocumentUpdates{}, err
+		}
+		update.FieldsToUpdate.MongoUpdates = append(update.FieldsToUpdate.MongoUpdates, mongoUpdate)
+	}
+	return update, nil
+}
+
+func encodeFieldUpdate(update FieldUpdate) (fieldUpdateJSON, error) {
+	encoded := fieldUpdateJSON{Op: update.Op, Path: update.Path, Key: update.Key}
+	var err error
+	switch update.Op {
+	case SetOp, IncrementOp:
+		encoded.Value, err = encodeValue(update.Value)
+	case ArrayRemoveOp, ArrayUnionOp:
+		encoded.Values, err = encodeValue(update.Values)
+	}
+	return encoded, err
+}
+
+func decodeFieldUpdate(encoded fieldUpdateJSON) (FieldUpdate, error) {
+	update := FieldUpdate{Op: encoded.Op, Path: encoded.Path, Key: encoded.Key}
+	switch encoded.Op {
+	case SetOp, IncrementOp:
+		value, err := decodeValue(encoded.Value)
+		if err != nil {
+			return FieldUpdate{}, err
+		}
+		update.Value = value
+	case ArrayRemoveOp, ArrayUnionOp:
+		value, err := decodeValue(encoded.Values)
+		if err != nil {
+			return FieldUpdate{}, err
+		}
+		update.Values, _ = value.([]interface{})
+	case UnsetOp, RemoveMapKeyOp:
+	default:
+		return FieldUpdate{}, fmt.Errorf("unknown update operation %q", encoded.Op)
+	}
+	return update, nil
+}
+
+func encodeFirestoreUpdate(update firestore.Update) (firestoreUpdateJSON, error) {
+	encoded := firestoreUpdateJSON{Path: update.Path, FieldPath: update.FieldPath}
+	value := update.Value
+	switch {
+	case value == firestore.Delete:
+		encoded.Transform = "delete"
+		return encoded, nil
+	case value == firestore.ServerTimestamp:
+		encoded.Transform = "serverTimestamp"
+		return encoded, nil
+	case isFirestoreTransform(value):
+		// the firestore package does not expose what its transforms hold
+		return firestoreUpdateJSON{}, fmt.Errorf("the field transform on %s cannot be encoded, use FieldUpdates.Updates", firestoreUpdatePath(update))
+	}
+
+	var err error
+	encoded.Value, err = encodeValue(value)
+	return encoded, err
+}
+
+func decodeFirestoreUpdate(encoded firestoreUpdateJSON) (firestore.Update, error) {
+	update := firestore.Update{Path: encoded.Path, FieldPath: encoded.FieldPath}
+	switch encoded.Transform {
+	case "delete":
+		update.Value = firestore.Delete
+		return update, nil
+	case "serverTimestamp":
+		update.Value = firestore.ServerTimestamp
+		return update, nil
+	}
+
+	value, err := decodeValue(encoded.Value)
+	if err != nil {
+		return firestore.Update{}, err
+	}
+	if encoded.Transform != "" {
+		return firestore.Update{}, fmt.Errorf("unknown firestore transform %q", encoded.Transform)
+	}
+	update.Value = value
+	return update, nil
+}
+
+// encodeValue encodes a single value as canonical Extended JSON.
+func encodeValue(value interface{}) (json.RawMessage, error) {
+	encoded, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// decodeValue decodes a value encoded by encodeValue into plain Go values:
+// maps, slices, strings, int32, int64, float64, booleans, time.Time and
+// ObjectIDs.
+func decodeValue(encoded json.RawMessage) (interface{}, error) {
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(encoded, true, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc) != 1 {
+		return nil, fmt.Errorf("invalid encoded value %s", encoded)
+	}
+	return decodedValue(doc[0].Value), nil
+}
+
+func decodedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		fields := make(map[string]interface{}, len(v))
+		for _, entry := range v {
+			fields[entry.Key] = decodedValue(entry.Value)
+		}
+		return fields
+	case bson.A:
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			elems[i] = decodedValue(elem)
+		}
+		return elems
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case primitive.Null:
+		return nil
+	}
+	return value
+}
@@ -0,0 +1,218 @@
+package pal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DeletionOutcome tells what happened to the plan of a deletion request.
+type DeletionOutcome string
+
+const (
+	// DeletionPlanned means the plan was built but not written, because
+	// writeToDatabase was false.
+	DeletionPlanned DeletionOutcome = "planned"
+	// DeletionApplied means every write of the plan was applied.
+	DeletionApplied DeletionOutcome = "applied"
+	// DeletionFailed means the plan could not be written. The error returned
+	// alongside the result tells which writes were applied.
+	DeletionFailed DeletionOutcome = "failed"
+)
+
+// DeletionResult describes a deletion request: the plan built from
+// HandleDeletion, how many documents of each DataType it touches, and whether
+// it was written.
+//
+// Its JSON form encodes NodesToDelete and DocumentsToUpdate as a DeletionPlan
+// does, so that a result read back from JSON can be passed to
+// ResumeDeletionRequest. As with a DeletionPlan, a result with Firestore field
+// transforms other than firestore.Delete and firestore.ServerTimestamp cannot
+// be encoded; use FieldUpdates.Updates for them instead.
+type DeletionResult struct {
+	DataSubjectID     string            `json:"dataSubjectId"`
+	WriteToDatabase   bool              `json:"writeToDatabase"`
+	NodesToDelete     []Locator         `json:"nodesToDelete"`
+	DocumentsToUpdate []DocumentUpdates `json:"documentsToUpdate"`
+	// Counts holds the number of documents deleted and updated, by DataType.
+	Counts  map[string]DeletionCounts `json:"counts"`
+	Outcome DeletionOutcome           `json:"outcome"`
+	// BatchSize is the number of writes applied per transaction, or 0 if the
+	// plan is written in a single transaction. See WithBatchSize.
+	BatchSize int `json:"batchSize,omitempty"`
+	// CommittedWrites is the number of writes of the plan, deletions first,
+	// that have been committed. ResumeDeletionRequest continues after them.
+	CommittedWrites int `json:"committedWrites"`
+	// Error is the message of the error that made the write fail, if any.
+	Error string `json:"error,omitempty"`
+	// Plan is the plan in a form that can be stored and applied later, if the
+	// request was made with WithDeletionPlan or by ApplyDeletionPlan.
+	Plan *DeletionPlan `json:"plan,omitempty"`
+	// Preview shows the effect of the plan on each document, if the request
+	// was made with WithPreview.
+	Preview *DeletionPreview `json:"preview,omitempty"`
+	// StartedAt is when the request started. PlanDuration is the time spent
+	// building the plan and WriteDuration the time spent writing it.
+	StartedAt     time.Time     `json:"startedAt"`
+	PlanDuration  time.Duration `json:"planDuration"`
+	WriteDuration time.Duration `json:"writeDuration"`
+}
+
+// DeletionCounts is the number of documents of one DataType a deletion
+// request deletes and updates.
+type DeletionCounts struct {
+	Deleted int `json:"deleted"`
+	Updated int `json:"updated"`
+}
+
+func newDeletionResult(dataSubjectID string, writeToDatabase bool, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) *DeletionResult {
+	counts := make(map[string]DeletionCounts)
+	for _, loc := range nodesToDelete {
+		c := counts[loc.DataType]
+		c.Deleted++
+		counts[loc.DataType] = c
+	}
+	for _, update := range documentsToUpdate {
+		c := counts[update.Locator.DataType]
+		c.Updated++
+		counts[update.Locator.DataType] = c
+	}
+	return &DeletionResult{
+		DataSubjectID:     dataSubjectID,
+		WriteToDatabase:   writeToDatabase,
+		NodesToDelete:     nodesToDelete,
+		DocumentsToUpdate: documentsToUpdate,
+		Counts:            counts,
+		Outcome:           DeletionPlanned,
+	}
+}
+
+// plainDeletionResult has the fields of a DeletionResult, but not its JSON
+// methods.
+type plainDeletionResult DeletionResult
+
+// deletionResultJSON is the JSON form of a DeletionResult. Its fields shadow
+// those of the embedded plainDeletionResult.
+type deletionResultJSON struct {
+	plainDeletionResult
+	NodesToDelete     []locatorJSON         `json:"nodesToDelete"`
+	DocumentsToUpdate []documentUpdatesJSON `json:"documentsToUpdate"`
+}
+
+func (r DeletionResult) MarshalJSON() ([]byte, error) {
+	encoded := deletionResultJSON{plainDeletionResult: plainDeletionResult(r)}
+	var err error
+	encoded.DocumentsToUpdate, encoded.NodesToDelete, err = encodeWrites(r.DocumentsToUpdate, r.NodesToDelete)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded)
+}
+
+func (r *DeletionResult) UnmarshalJSON(data []byte) error {
+	var encoded deletionResultJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	result := DeletionResult(encoded.plainDeletionResult)
+	var err error
+	result.DocumentsToUpdate, result.NodesToDelete, err = decodeWrites(encoded.DocumentsToUpdate, encoded.NodesToDelete)
+	if err != nil {
+		return err
+	}
+	*r = result
+	return nil
+}
+
+func (r *DeletionResult) writeCount() int {
+	return len(r.NodesToDelete) + len(r.DocumentsToUpdate)
+}
+
+// batch returns the updates and deletions among the writes of the plan from
+// start to end, where deletions come before updates.
+func (r *DeletionResult) batch(start, end int) (documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) {
+	deletions := len(r.NodesToDelete)
+	clamp := func(i, min, max int) int {
+		if i < min {
+			return min
+		}
+		if i > max {
+			return max
+		}
+		return i
+	}
+	nodesToDelete = r.NodesToDelete[clamp(start, 0, deletions):clamp(end, 0, deletions)]
+	documentsToUpdate = r.DocumentsToUpdate[clamp(start-deletions, 0, len(r.DocumentsToUpdate)):clamp(end-deletions, 0, len(r.DocumentsToUpdate))]
+	return documentsToUpdate, nodesToDelete
+}
+
+// locators returns the locators of the writes from start to end.
+func (r *DeletionResult) locators(start, end int) []Locator {
+	return writeLocators(r.batch(start, end))
+}
+
+// WriteJSON writes r to w as indented JSON.
+func (r *DeletionResult) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteMarkdown writes a summary of r to w as Markdown, listing every document
+// the plan deletes or updates.
+func (r *DeletionResult) WriteMarkdown(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Deletion request for data subject %s\n\n", r.DataSubjectID)
+	b.WriteString("| | |\n| --- | --- |\n")
+	fmt.Fprintf(&b, "| Outcome | %s |\n", r.Outcome)
+	fmt.Fprintf(&b, "| Started | %s |\n", r.StartedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "| Planning took | %s |\n", r.PlanDuration)
+	if r.WriteToDatabase {
+		fmt.Fprintf(&b, "| Writing took | %s |\n", r.WriteDuration)
+		fmt.Fprintf(&b, "| Committed writes | %d of %d |\n", r.CommittedWrites, r.writeCount())
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "| Error | %s |\n", markdownCell(r.Error))
+	}
+
+	b.WriteString("\n## Documents by data type\n\n")
+	b.WriteString("| Data type | Deleted | Updated |\n| --- | ---: | ---: |\n")
+	dataTypes := make([]string, 0, len(r.Counts))
+	for dataType := range r.Counts {
+		dataTypes = append(dataTypes, dataType)
+	}
+	sort.Strings(dataTypes)
+	for _, dataType := range dataTypes {
+		c := r.Counts[dataType]
+		fmt.Fprintf(&b, "| %s | %d | %d |\n", markdownCell(dataType), c.Deleted, c.Updated)
+	}
+
+	b.WriteString("\n## Deleted documents\n\n")
+	for _, loc := range r.NodesToDelete {
+		fmt.Fprintf(&b, "- `%s` (%s)\n", loc.key(), loc.DataType)
+	}
+	if len(r.NodesToDelete) == 0 {
+		b.WriteString("None.\n")
+	}
+
+	b.WriteString("\n## Updated documents\n\n")
+	for _, update := range r.DocumentsToUpdate {
+		fmt.Fprintf(&b, "- `%s` (%s)\n", update.Locator.key(), update.Locator.DataType)
+	}
+	if len(r.DocumentsToUpdate) == 0 {
+		b.WriteString("None.\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// markdownCell escapes s for use in a Markdown table cell.
+func markdownCell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
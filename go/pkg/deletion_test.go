@@ -0,0 +1,863 @@
+package pal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// failingBackend fails every write with err.
+type failingBackend struct {
+	*MemoryBackend
+	err error
+}
+
+func (b *failingBackend) UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	return b.err
+}
+
+// handleDeletionFriends deletes a user and their chats and removes nothing
+// from anyone else.
+func handleDeletionFriends(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+	switch currentDbObjLocator.DataType {
+	case "user":
+		chats := Locator{
+			LocatorType:      Collection,
+			DataType:         "chat",
+			FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, Filters: []Filter{{Path: "users", Op: "array-contains", Value: dbObj["_id"]}}},
+		}
+		return []Locator{chats}, true, FieldUpdates{}, nil
+	case "chat":
+		return nil, true, FieldUpdates{}, nil
+	}
+	return nil, false, FieldUpdates{}, fmt.Errorf("invalid data type %s", currentDbObjLocator.DataType)
+}
+
+func TestDeletionRequestWriteError(t *testing.T) {
+	storeErr := errors.New("transaction aborted")
+	backend := &failingBackend{MemoryBackend: newFriendsBackend(t), err: storeErr}
+
+	result, err := NewClient(backend).ProcessDeletionRequest(handleDeletionFriends, friendsSubject("u1"), "u1", true)
+	if result == nil || result.Outcome != DeletionFailed || result.Error == "" {
+		t.Errorf("got result %+v, want a failed outcome with an error", result)
+	}
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) {
+		t.Fatalf("got error %v, want a *WriteError", err)
+	}
+	if !errors.Is(err, storeErr) {
+		t.Errorf("got error %v, want it to wrap %v", err, storeErr)
+	}
+	if len(writeErr.Applied) != 0 {
+		t.Errorf("got %d applied writes, want none", len(writeErr.Applied))
+	}
+	if len(writeErr.NotApplied) != 2 {
+		t.Errorf("got %d writes not applied, want 2", len(writeErr.NotApplied))
+	}
+	if _, ok := backend.Get("users/u1"); !ok {
+		t.Errorf("users/u1 was deleted")
+	}
+
+	// a backend that knows which writes went through reports them itself
+	backend.err = &WriteError{Applied: writeErr.NotApplied[:1], NotApplied: writeErr.NotApplied[1:], Err: storeErr}
+	_, err = NewClient(backend).ProcessDeletionRequest(handleDeletionFriends, friendsSubject("u1"), "u1", true)
+	if !errors.As(err, &writeErr) || len(writeErr.Applied) != 1 || len(writeErr.NotApplied) != 1 {
+		t.Errorf("got error %v, want the backend's *WriteError", err)
+	}
+
+	// nothing is written when writeToDatabase is false
+	if _, err := NewClient(backend).ProcessDeletionRequest(handleDeletionFriends, friendsSubject("u1"), "u1", false); err != nil {
+		t.Errorf("got error %v for a dry run", err)
+	}
+}
+
+func TestDeletionRequestCancel(t *testing.T) {
+	backend := newFriendsBackend(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	// cancel the request while the plan is being built
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		if currentDbObjLocator.DataType == "user" {
+			cancel()
+		}
+		return handleDeletionFriends(dataSubjectId, currentDbObjLocator, dbObj)
+	}
+	_, err := NewClient(backend).ProcessDeletionRequestWithContext(ctx, handleDeletion, friendsSubject("u1"), "u1", true)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	_, err = NewClient(backend).ProcessDeletionRequestWithContext(expired, handleDeletionFriends, friendsSubject("u1"), "u1", true)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want context.DeadlineExceeded", err)
+	}
+	for _, path := range []string{"users/u1", "chats/c1"} {
+		if _, ok := backend.Get(path); !ok {
+			t.Errorf("%s was deleted by a cancelled request", path)
+		}
+	}
+}
+
+func TestMemoryBackendWriteError(t *testing.T) {
+	backend := newFriendsBackend(t)
+	missing := Locator{
+		LocatorType:      Document,
+		DataType:         "user",
+		FirestoreLocator: FirestoreLocator{CollectionPath: []string{"users"}, DocIDs: []string{"missing"}},
+	}
+	err := backend.UpdateAndDelete(context.Background(), []DocumentUpdates{{Locator: missing}}, []Locator{friendsSubject("u1")})
+	if err == nil {
+		t.Fatal("expected an error updating a document that does not exist")
+	}
+	if _, ok := backend.Get("users/u1"); !ok {
+		t.Errorf("users/u1 was deleted although the write failed")
+	}
+}
+
+func TestDeletionResult(t *testing.T) {
+	backend := newFriendsBackend(t)
+	result, err := NewClient(backend).ProcessDeletionRequest(handleDeletionFriends, friendsSubject("u1"), "u1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != DeletionPlanned {
+		t.Errorf("got outcome %s, want %s", result.Outcome, DeletionPlanned)
+	}
+	wantCounts := map[string]DeletionCounts{"user": {Deleted: 1}, "chat": {Deleted: 1}}
+	if !reflect.DeepEqual(result.Counts, wantCounts) {
+		t.Errorf("got counts %v, want %v", result.Counts, wantCounts)
+	}
+
+	var encoded bytes.Buffer
+	if err := result.WriteJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"dataSubjectId", "writeToDatabase", "nodesToDelete", "documentsToUpdate", "counts", "outcome"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("JSON result has no %q key", key)
+		}
+	}
+
+	var markdown strings.Builder
+	if err := result.WriteMarkdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"| Outcome | planned |", "| chat | 1 | 0 |", "| user | 1 | 0 |", "- `users/u1` (user)", "- `chats/c1` (chat)"} {
+		if !strings.Contains(markdown.String(), want) {
+			t.Errorf("Markdown result does not contain %q:\n%s", want, markdown.String())
+		}
+	}
+
+	result, err = NewClient(backend).ProcessDeletionRequest(handleDeletionFriends, friendsSubject("u1"), "u1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != DeletionApplied {
+		t.Errorf("got outcome %s, want %s", result.Outcome, DeletionApplied)
+	}
+}
+
+// flakyBackend fails the write with the given call number, counting from 1.
+type flakyBackend struct {
+	*MemoryBackend
+	failOn int
+	calls  int
+}
+
+func (b *flakyBackend) UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	b.calls++
+	if b.calls == b.failOn {
+		return errors.New("deadline exceeded")
+	}
+	return b.MemoryBackend.UpdateAndDelete(ctx, documentsToUpdate, nodesToDelete)
+}
+
+func TestDeletionRequestBatches(t *testing.T) {
+	backend := &flakyBackend{MemoryBackend: newGeneratedFriendsBackend(t, 5), failOn: 2}
+	client := NewClient(backend)
+
+	// u1 is in chats c0 and c1, so the plan deletes c0, c1 and u1
+	result, err := client.ProcessDeletionRequest(handleDeletionFriends, friendsSubject("u1"), "u1", true, WithBatchSize(1))
+	var writeErr *WriteError
+	if !errors.As(err, &writeErr) {
+		t.Fatalf("got error %v, want a *WriteError", err)
+	}
+	if result.Outcome != DeletionFailed || result.CommittedWrites != 1 {
+		t.Errorf("got outcome %s after %d writes, want %s after 1", result.Outcome, result.CommittedWrites, DeletionFailed)
+	}
+	keys := func(locs []Locator) []string {
+		keys := make([]string, len(locs))
+		for i, loc := range locs {
+			keys[i] = loc.key()
+		}
+		return keys
+	}
+	if got, want := keys(writeErr.Applied), []string{"chats/c0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got applied %v, want %v", got, want)
+	}
+	if got, want := keys(writeErr.NotApplied), []string{"chats/c1", "users/u1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got not applied %v, want %v", got, want)
+	}
+	if _, ok := backend.Get("chats/c0"); ok {
+		t.Errorf("chats/c0 was not deleted by the first batch")
+	}
+
+	if err := client.ResumeDeletionRequest(context.Background(), result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != DeletionApplied || result.CommittedWrites != 3 || result.Error != "" {
+		t.Errorf("got outcome %s after %d writes (%s), want %s after 3", result.Outcome, result.CommittedWrites, result.Error, DeletionApplied)
+	}
+	// one failed call, then the two remaining batches
+	if backend.calls != 4 {
+		t.Errorf("got %d writes, want 4", backend.calls)
+	}
+	for _, path := range []string{"chats/c1", "users/u1"} {
+		if _, ok := backend.Get(path); ok {
+			t.Errorf("%s was not deleted", path)
+		}
+	}
+
+	if err := client.ResumeDeletionRequest(context.Background(), result); err == nil {
+		t.Errorf("expected an error resuming a deletion that has been applied")
+	}
+}
+
+func TestDeletionRequestResumeFromJSON(t *testing.T) {
+	memory := newTestMongoBackend(t)
+	backend := &flakyBackend{MemoryBackend: memory, failOn: 2}
+	chat := testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, testChatID)}})
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		switch currentDbObjLocator.DataType {
+		case "user":
+			messages := testLocator("message", Collection, nil, nil, "messages", bson.D{{Key: "userId", Value: dataSubjectId}})
+			return []Locator{messages, chat}, true, FieldUpdates{}, nil
+		case "message":
+			return nil, true, FieldUpdates{}, nil
+		}
+		return nil, false, FieldUpdates{Updates: []FieldUpdate{ArrayRemove("users", dataSubjectId), Increment("edits", 1)}}, nil
+	}
+	subject := testLocator("user", Document, nil, nil, "users", bson.D{{Key: "_id", Value: objectID(t, testUserID)}})
+
+	// m1 is deleted, then writing m3 fails
+	result, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, subject, testUserID, true, WithBatchSize(1))
+	if err == nil || result.CommittedWrites != 1 {
+		t.Fatalf("got error %v after %d writes, want an error after 1", err, result.CommittedWrites)
+	}
+
+	var encoded bytes.Buffer
+	if err := result.WriteJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+	var decoded DeletionResult
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	// a hex string would not match the ObjectID in MongoDB
+	if !reflect.DeepEqual(decoded.NodesToDelete, result.NodesToDelete) {
+		t.Errorf("got deletions %+v after a round trip, want %+v", decoded.NodesToDelete, result.NodesToDelete)
+	}
+	if err := NewClient(memory).ResumeDeletionRequest(context.Background(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Outcome != DeletionApplied || decoded.CommittedWrites != 4 {
+		t.Errorf("got outcome %s after %d writes, want %s after 4", decoded.Outcome, decoded.CommittedWrites, DeletionApplied)
+	}
+	for _, path := range []string{"messages/m1", "messages/m3", "users/" + testUserID} {
+		if _, ok := memory.Get(path); ok {
+			t.Errorf("%s was not deleted", path)
+		}
+	}
+	// the increment is decoded as the int32 MongoDB would have stored
+	got, _ := memory.Get("gcs/" + testChatID)
+	want := DatabaseObject{"_id": testChatID, "owner": testOtherID, "users": []interface{}{testOtherID}, "edits": int32(1)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got chat %v, want %v", got, want)
+	}
+}
+
+func TestNormalizePlan(t *testing.T) {
+	user := friendsSubject("u1")
+	chat := Locator{LocatorType: Document, DataType: "chat", FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, DocIDs: []string{"c1"}}}
+	other := Locator{LocatorType: Document, DataType: "chat", FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, DocIDs: []string{"c2"}}}
+
+	documentsToUpdate := []DocumentUpdates{
+		{Locator: chat, FieldsToUpdate: FieldUpdates{FirestoreUpdates: []firestore.Update{
+			{Path: "users", Value: firestore.ArrayRemove("u1")},
+			{Path: "edits", Value: firestore.Increment(1)},
+		}}},
+		{Locator: user, FieldsToUpdate: FieldUpdates{FirestoreUpdates: []firestore.Update{{Path: "name", Value: firestore.Delete}}}},
+		{Locator: chat, FieldsToUpdate: FieldUpdates{FirestoreUpdates: []firestore.Update{
+			{Path: "users", Value: firestore.ArrayRemove("u1")},
+			{Path: "edits", Value: firestore.Increment(1)},
+		}}},
+	}
+	nodesToDelete := []Locator{other, user, other}
+
+	updates, deletes, err := normalizePlan(documentsToUpdate, nodesToDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Locator{other, user}; !reflect.DeepEqual(deletes, want) {
+		t.Errorf("got deletions %v, want %v", deletes, want)
+	}
+	want := []DocumentUpdates{{Locator: chat, FieldsToUpdate: FieldUpdates{FirestoreUpdates: []firestore.Update{
+		{Path: "users", Value: firestore.ArrayRemove("u1")},
+		{Path: "edits", Value: firestore.Increment(1)},
+	}}}}
+	if !reflect.DeepEqual(updates, want) {
+		t.Errorf("got updates %+v, want %+v", updates, want)
+	}
+
+	// field transforms are opaque, so different ones of a field conflict;
+	// FieldUpdates.Updates merges them instead
+	conflicting := append(documentsToUpdate, DocumentUpdates{Locator: chat, FieldsToUpdate: FieldUpdates{FirestoreUpdates: []firestore.Update{
+		{Path: "users", Value: firestore.ArrayRemove("u2")},
+		{Path: "edits", Value: 0},
+		{Path: "users.owner", Value: "u2"},
+	}}})
+	_, _, err = normalizePlan(conflicting, nil)
+	var conflictErr *PlanConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("got error %v, want a *PlanConflictError", err)
+	}
+	var fields []string
+	for _, conflict := range conflictErr.Conflicts {
+		fields = append(fields, conflict.Field)
+	}
+	if want := []string{"users", "edits", "users.owner"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("got conflicts on %v, want %v", fields, want)
+	}
+}
+
+func TestNormalizePlanAcrossCategories(t *testing.T) {
+	chat := Locator{LocatorType: Document, DataType: "chat", FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, DocIDs: []string{"c1"}}}
+	documentsToUpdate := []DocumentUpdates{
+		{Locator: chat, FieldsToUpdate: FieldUpdates{
+			Updates:          []FieldUpdate{Set("name", "anonymous"), Unset("profile"), Set("title", "none")},
+			FirestoreUpdates: []firestore.Update{{Path: "color", Value: "grey"}},
+			MongoUpdates:     []interface{}{bson.D{{Key: "$set", Value: bson.D{{Key: "color", Value: "grey"}}}}},
+		}},
+		// the same fields, from the handler of another path to the document
+		{Locator: chat, FieldsToUpdate: FieldUpdates{
+			FirestoreUpdates: []firestore.Update{{Path: "name", Value: "firestore-anon"}},
+			MongoUpdates:     []interface{}{bson.D{{Key: "$set", Value: bson.D{{Key: "profile.city", Value: ""}}}}},
+		}},
+	}
+	_, _, err := normalizePlan(documentsToUpdate, nil)
+	var conflictErr *PlanConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("got error %v, want a *PlanConflictError", err)
+	}
+	var fields []string
+	for _, conflict := range conflictErr.Conflicts {
+		fields = append(fields, conflict.Field)
+	}
+	// color is only changed by one backend's updates, and title only once
+	if want := []string{"name", "profile"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("got conflicts on %v, want %v", fields, want)
+	}
+}
+
+func TestNormalizePlanMongo(t *testing.T) {
+	chat := testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, testChatID)}})
+	pull := func(id string) interface{} {
+		return bson.D{{Key: "$pull", Value: bson.D{{Key: "users", Value: id}}}}
+	}
+	documentsToUpdate := []DocumentUpdates{
+		{Locator: chat, FieldsToUpdate: FieldUpdates{MongoUpdates: []interface{}{pull(testUserID), bson.M{"$set": bson.M{"owner": "nobody"}}}}},
+		{Locator: chat, FieldsToUpdate: FieldUpdates{MongoUpdates: []interface{}{pull(testUserID), pull(testOtherID)}}},
+	}
+
+	updates, _, err := normalizePlan(documentsToUpdate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "users", Value: testUserID}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "owner", Value: "nobody"}}}},
+		bson.D{{Key: "$pull", Value: bson.D{{Key: "users", Value: testOtherID}}}},
+	}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].FieldsToUpdate.MongoUpdates, want) {
+		t.Errorf("got updates %+v, want %v", updates, want)
+	}
+
+	conflicting := append(documentsToUpdate, DocumentUpdates{Locator: chat, FieldsToUpdate: FieldUpdates{MongoUpdates: []interface{}{
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "owner", Value: ""}}}},
+	}}})
+	var conflictErr *PlanConflictError
+	if _, _, err := normalizePlan(conflicting, nil); !errors.As(err, &conflictErr) {
+		t.Errorf("got error %v, want a *PlanConflictError", err)
+	}
+}
+
+func TestNormalizePlanMongoPipeline(t *testing.T) {
+	chat := testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, testChatID)}})
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: "owner", Value: bson.D{{Key: "$first", Value: "$users"}}}}}}}
+	array := bson.A{bson.D{{Key: "$unset", Value: "nickname"}}}
+	plain := bson.D{{Key: "owner", Value: testOtherID}}
+	pull := bson.D{{Key: "$pull", Value: bson.D{{Key: "users", Value: testUserID}}}}
+
+	// updates other than operator documents are kept as they are, in order
+	documentsToUpdate := []DocumentUpdates{
+		{Locator: chat, FieldsToUpdate: FieldUpdates{MongoUpdates: []interface{}{pull, pipeline}}},
+		{Locator: chat, FieldsToUpdate: FieldUpdates{MongoUpdates: []interface{}{array, pipeline, pull, plain}}},
+	}
+	updates, _, err := normalizePlan(documentsToUpdate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{pull, pipeline, array, plain}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0].FieldsToUpdate.MongoUpdates, want) {
+		t.Errorf("got updates %+v, want %v", updates, want)
+	}
+
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		if currentDbObjLocator.DataType == "user" {
+			return []Locator{chat}, true, FieldUpdates{}, nil
+		}
+		return nil, false, FieldUpdates{MongoUpdates: []interface{}{pull, pipeline}}, nil
+	}
+	subject := testLocator("user", Document, nil, nil, "users", bson.D{{Key: "_id", Value: objectID(t, testUserID)}})
+	result, err := NewClient(newTestMongoBackend(t)).ProcessDeletionRequest(handleDeletion, subject, testUserID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.DocumentsToUpdate) != 1 || !reflect.DeepEqual(result.DocumentsToUpdate[0].FieldsToUpdate.MongoUpdates, []interface{}{pull, pipeline}) {
+		t.Errorf("got updates %+v in a dry run", result.DocumentsToUpdate)
+	}
+}
+
+func TestDeletionPreview(t *testing.T) {
+	backend := newFriendsBackend(t)
+	if err := backend.Put("chats/c1", map[string]interface{}{
+		"title": "shared",
+		"users": []interface{}{"u1", "u2"},
+		"meta":  map[string]interface{}{"owner": "u1", "color": "blue"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		if currentDbObjLocator.DataType == "chat" {
+			return nil, false, FieldUpdates{
+				Updates: []FieldUpdate{ArrayRemove("users", dataSubjectId)},
+				FirestoreUpdates: []firestore.Update{
+					{Path: "meta.owner", Value: firestore.Delete},
+					{Path: "anonymized", Value: true},
+				},
+			}, nil
+		}
+		return handleDeletionFriends(dataSubjectId, currentDbObjLocator, dbObj)
+	}
+
+	result, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, friendsSubject("u1"), "u1", false, WithPreview())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Preview == nil || len(result.Preview.Documents) != 2 {
+		t.Fatalf("got preview %+v, want two documents", result.Preview)
+	}
+
+	deleted := result.Preview.Documents[0]
+	if !deleted.Deleted || deleted.Before["name"] != "user1" || deleted.After != nil {
+		t.Errorf("got deleted document %+v, want users/u1 in full", deleted)
+	}
+	updated := result.Preview.Documents[1]
+	wantChanges := []FieldChange{
+		{Path: "anonymized", Kind: FieldAdded, After: true},
+		{Path: "meta.owner", Kind: FieldRemoved, Before: "u1"},
+		{Path: "users", Kind: FieldChanged, Before: []interface{}{"u1", "u2"}, After: []interface{}{"u2"}},
+	}
+	if updated.Deleted || !reflect.DeepEqual(updated.Changes, wantChanges) {
+		t.Errorf("got changes %+v, want %+v", updated.Changes, wantChanges)
+	}
+	if chat, _ := backend.Get("chats/c1"); !reflect.DeepEqual(chat["users"], []interface{}{"u1", "u2"}) {
+		t.Errorf("preview changed the stored document: %v", chat)
+	}
+
+	var text strings.Builder
+	if err := result.Preview.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"DELETE users/u1 (user)\n  _id: \"u1\"\n",
+		"  name: \"user1\"\n",
+		"UPDATE chats/c1 (chat)\n",
+		"  + anonymized: true\n",
+		"  - meta.owner: \"u1\"\n",
+		"  ~ users: [\"u1\",\"u2\"] -> [\"u2\"]\n",
+	} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text preview does not contain %q:\n%s", want, text.String())
+		}
+	}
+}
+
+// TestDeletionPreviewMixed previews updates that set a field differently in
+// Firestore and MongoDB: the preview shows what the backend would write.
+func TestDeletionPreviewMixed(t *testing.T) {
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		return nil, false, FieldUpdates{
+			FirestoreUpdates: []firestore.Update{{Path: "name", Value: "firestore-anon"}},
+			MongoUpdates:     []interface{}{bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "mongo-anon"}}}}},
+		}, nil
+	}
+	tests := []struct {
+		name    string
+		backend *MemoryBackend
+		subject Locator
+		want    string
+	}{
+		{"firestore", newTestFirestoreBackend(t), Ref("users", testUserID).Locator("user"), "firestore-anon"},
+		{"mongo", newTestMongoBackend(t), Ref("users", testUserID).Locator("user"), "mongo-anon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(tt.backend)
+			result, err := client.ProcessDeletionRequest(handleDeletion, tt.subject, testUserID, true, WithPreview())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := result.Preview.Documents[0].After["name"]; got != tt.want {
+				t.Errorf("got name %v in the preview, want %s", got, tt.want)
+			}
+			if stored, _ := tt.backend.Get("users/" + testUserID); stored["name"] != tt.want {
+				t.Errorf("got name %v written, want %s", stored["name"], tt.want)
+			}
+
+			// locators are encoded as in a DeletionPlan, so they read back
+			encoded, err := json.Marshal(result.Preview)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded DeletionPreview
+			if err := json.Unmarshal(encoded, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := decoded.Documents[0].Locator, result.Preview.Documents[0].Locator; !reflect.DeepEqual(got, want) {
+				t.Errorf("got locator %+v after a round trip, want %+v", got, want)
+			}
+		})
+	}
+
+	// the semantics of other backends are not known
+	_, err := NewClient(&countingBackend{Backend: newTestMongoBackend(t)}).ProcessDeletionRequest(handleDeletion, Ref("users", testUserID).Locator("user"), testUserID, false, WithPreview())
+	if err == nil {
+		t.Error("got no error previewing updates on a custom backend")
+	}
+}
+
+func TestDeletionPreviewTransforms(t *testing.T) {
+	backend := newFriendsBackend(t)
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		if currentDbObjLocator.DataType == "chat" {
+			return nil, false, FieldUpdates{
+				Updates:          []FieldUpdate{Set("title", "anonymized")},
+				FirestoreUpdates: []firestore.Update{{Path: "users", Value: firestore.ArrayRemove(dataSubjectId)}},
+			}, nil
+		}
+		return handleDeletionFriends(dataSubjectId, currentDbObjLocator, dbObj)
+	}
+
+	result, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, friendsSubject("u1"), "u1", false, WithPreview())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantChanges := []FieldChange{
+		{Path: "title", Kind: FieldChanged, Before: "shared", After: "anonymized"},
+		{Path: "users", Kind: FieldNotPreviewable, Before: []interface{}{"u1", "u2"}},
+	}
+	if got := result.Preview.Documents[1].Changes; !reflect.DeepEqual(got, wantChanges) {
+		t.Errorf("got changes %+v, want %+v", got, wantChanges)
+	}
+
+	var text strings.Builder
+	if err := result.Preview.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if want := "  ? users: not previewable, changed by a Firestore field transform\n"; !strings.Contains(text.String(), want) {
+		t.Errorf("preview text does not contain %q:\n%s", want, text.String())
+	}
+}
+
+// handleDeletionFriendsUpdate deletes a user and removes them from their chats.
+func handleDeletionFriendsUpdate(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+	if currentDbObjLocator.DataType == "chat" {
+		return nil, false, FieldUpdates{
+			Updates:          []FieldUpdate{ArrayRemove("users", dataSubjectId), Increment("edits", 1)},
+			FirestoreUpdates: []firestore.Update{{Path: "title", Value: firestore.Delete}},
+		}, nil
+	}
+	return handleDeletionFriends(dataSubjectId, currentDbObjLocator, dbObj)
+}
+
+func TestDeletionPlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend func(*MemoryBackend) Backend
+	}{
+		{"conditional", func(m *MemoryBackend) Backend { return m }},
+		{"unconditional", func(m *MemoryBackend) Backend { return &countingBackend{Backend: m} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := newFriendsBackend(t)
+			client := NewClient(tt.backend(memory))
+
+			result, err := client.ProcessDeletionRequest(handleDeletionFriendsUpdate, friendsSubject("u1"), "u1", false, WithDeletionPlan())
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded, err := json.Marshal(result.Plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var plan DeletionPlan
+			if err := json.Unmarshal(encoded, &plan); err != nil {
+				t.Fatal(err)
+			}
+			if plan.Version != DeletionPlanVersion || plan.DataSubjectID != "u1" || len(plan.Fingerprints) != 2 {
+				t.Errorf("got plan %+v", plan)
+			}
+			if _, ok := memory.Get("users/u1"); !ok {
+				t.Fatalf("users/u1 was deleted before the plan was applied")
+			}
+
+			applied, err := client.ApplyDeletionPlan(context.Background(), &plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied.Outcome != DeletionApplied {
+				t.Errorf("got outcome %s, want %s", applied.Outcome, DeletionApplied)
+			}
+			if _, ok := memory.Get("users/u1"); ok {
+				t.Errorf("users/u1 was not deleted")
+			}
+			chat, _ := memory.Get("chats/c1")
+			want := DatabaseObject{"_id": "c1", "users": []interface{}{"u2"}, "edits": int64(1)}
+			if !reflect.DeepEqual(chat, want) {
+				t.Errorf("got chat %v, want %v", chat, want)
+			}
+		})
+	}
+}
+
+func TestDeletionPlanStale(t *testing.T) {
+	memory := newFriendsBackend(t)
+	client := NewClient(memory)
+	result, err := client.ProcessDeletionRequest(handleDeletionFriendsUpdate, friendsSubject("u1"), "u1", false, WithDeletionPlan())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := memory.Put("chats/c1", map[string]interface{}{"title": "renamed", "users": []interface{}{"u1", "u2"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ApplyDeletionPlan(context.Background(), result.Plan)
+	var staleErr *StaleDocumentError
+	if !errors.As(err, &staleErr) {
+		t.Fatalf("got error %v, want a *StaleDocumentError", err)
+	}
+	if len(staleErr.Locators) != 1 || staleErr.Locators[0].key() != "chats/c1" {
+		t.Errorf("got stale documents %v, want chats/c1", staleErr.Locators)
+	}
+	if _, ok := memory.Get("users/u1"); !ok {
+		t.Errorf("users/u1 was deleted although the plan is stale")
+	}
+
+	result.Plan.Version = DeletionPlanVersion + 1
+	if _, err := client.ApplyDeletionPlan(context.Background(), result.Plan); err == nil {
+		t.Errorf("expected an error applying a plan of another version")
+	}
+	if _, err := client.ApplyDeletionPlan(context.Background(), nil); err == nil {
+		t.Errorf("expected an error applying a nil plan")
+	}
+}
+
+func TestDeletionPlanChangedWhilePlanning(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend func(*MemoryBackend) Backend
+	}{
+		{"conditional", func(m *MemoryBackend) Backend { return m }},
+		{"unconditional", func(m *MemoryBackend) Backend { return &countingBackend{Backend: m} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := newFriendsBackend(t)
+			client := NewClient(tt.backend(memory))
+			// chats/c1 changes after the handler read it, but before the plan
+			// is made, so the plan must not describe the new version
+			handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+				if currentDbObjLocator.DataType == "chat" {
+					if err := memory.Put("chats/c1", map[string]interface{}{"title": "renamed", "users": []interface{}{"u1", "u2", "u3"}}); err != nil {
+						return nil, false, FieldUpdates{}, err
+					}
+				}
+				return handleDeletionFriendsUpdate(dataSubjectId, currentDbObjLocator, dbObj)
+			}
+
+			result, err := client.ProcessDeletionRequest(handleDeletion, friendsSubject("u1"), "u1", false, WithDeletionPlan())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.ApplyDeletionPlan(context.Background(), result.Plan)
+			var staleErr *StaleDocumentError
+			if !errors.As(err, &staleErr) {
+				t.Fatalf("got error %v, want a *StaleDocumentError", err)
+			}
+			if len(staleErr.Locators) != 1 || staleErr.Locators[0].key() != "chats/c1" {
+				t.Errorf("got stale documents %v, want chats/c1", staleErr.Locators)
+			}
+		})
+	}
+}
+
+func TestFingerprintNotFound(t *testing.T) {
+	memory := newFriendsBackend(t)
+	_, err := memory.Fingerprint(context.Background(), friendsSubject("missing"))
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("got error %v, want it to wrap ErrDocumentNotFound", err)
+	}
+}
+
+func TestDeletionPlanEncoding(t *testing.T) {
+	chat := testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, testChatID)}})
+	user := testLocator("user", Document, []string{"users"}, []string{testUserID}, "", nil)
+	messages := testLocator("message", Collection, nil, nil, "messages", nil)
+	messages.Where = []Filter{{Path: "tags", Op: "array-contains-any", Value: []interface{}{"a", int64(1)}}}
+	plan := &DeletionPlan{
+		Version:       DeletionPlanVersion,
+		DataSubjectID: testUserID,
+		NodesToDelete: []Locator{user, messages},
+		DocumentsToUpdate: []DocumentUpdates{{Locator: chat, FieldsToUpdate: FieldUpdates{
+			Updates: []FieldUpdate{
+				ArrayRemove("users", "a", int64(2)),
+				Set("profile.name", "nobody"),
+				Increment("edits", int64(1)),
+				RemoveMapKey("nicknames", "a.b"),
+			},
+			FirestoreUpdates: []firestore.Update{
+				{Path: "title", Value: firestore.Delete},
+				{FieldPath: []string{"profile", "name"}, Value: firestore.ServerTimestamp},
+				{Path: "count", Value: int64(1 << 40)},
+			},
+			MongoUpdates: []interface{}{
+				bson.D{{Key: "$pull", Value: bson.D{{Key: "users", Value: objectID(t, testUserID)}}}},
+			},
+		}}},
+	}
+
+	encoded, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded DeletionPlan
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.NodesToDelete, plan.NodesToDelete) {
+		t.Errorf("got deletions %+v, want %+v", decoded.NodesToDelete, plan.NodesToDelete)
+	}
+	if !reflect.DeepEqual(decoded.DocumentsToUpdate, plan.DocumentsToUpdate) {
+		t.Errorf("got updates %+v, want %+v", decoded.DocumentsToUpdate, plan.DocumentsToUpdate)
+	}
+
+	// the firestore package does not expose what its field transforms hold
+	for _, transform := range []interface{}{firestore.ArrayUnion("a"), firestore.ArrayRemove("a"), firestore.Increment(1)} {
+		plan.DocumentsToUpdate[0].FieldsToUpdate.FirestoreUpdates = []firestore.Update{{Path: "users", Value: transform}}
+		if _, err := json.Marshal(plan); err == nil {
+			t.Errorf("got no error encoding the field transform %T", transform)
+		}
+	}
+}
+
+func TestFieldUpdates(t *testing.T) {
+	updates := FieldUpdates{Updates: []FieldUpdate{
+		ArrayRemove("users", testUserID),
+		ArrayUnion("admins", testOtherID),
+		Set("settings.color", "blue"),
+		Increment("edits", 1),
+		RemoveMapKey("nicknames", testUserID),
+		Unset("owner"),
+	}}
+	want := map[string]interface{}{
+		"users":     []interface{}{testOtherID},
+		"admins":    []interface{}{testOtherID},
+		"settings":  map[string]interface{}{"color": "blue", "muted": true},
+		"edits":     int64(3),
+		"nicknames": map[string]interface{}{testOtherID: "two"},
+	}
+
+	tests := []struct {
+		name    string
+		backend *MemoryBackend
+		chat    Locator
+	}{
+		{"firestore", newTestFirestoreBackend(t), testLocator("groupchat", Document, []string{"gcs"}, []string{testChatID}, "", nil)},
+		{"mongo", newTestMongoBackend(t), testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, testChatID)}})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.backend.Put("gcs/"+testChatID, map[string]interface{}{
+				"owner":     testOtherID,
+				"users":     []interface{}{testUserID, testOtherID},
+				"settings":  map[string]interface{}{"muted": true},
+				"edits":     int64(2),
+				"nicknames": map[string]interface{}{testUserID: "one", testOtherID: "two"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			err := tt.backend.UpdateAndDelete(context.Background(), []DocumentUpdates{{Locator: tt.chat, FieldsToUpdate: updates}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := tt.backend.Get("gcs/" + testChatID)
+			delete(got, "_id")
+			if !valuesEqual(map[string]interface{}(got), want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+
+	chat := tests[1].chat
+	dotted := []DocumentUpdates{{Locator: chat, FieldsToUpdate: FieldUpdates{Updates: []FieldUpdate{RemoveMapKey("nicknames", "a.b")}}}}
+	if err := newTestMongoBackend(t).UpdateAndDelete(context.Background(), dotted, nil); err == nil {
+		t.Error("got no error removing a dotted map key in MongoDB")
+	}
+
+	merged, _, err := normalizePlan([]DocumentUpdates{
+		{Locator: chat, FieldsToUpdate: FieldUpdates{Updates: []FieldUpdate{ArrayRemove("users", "a"), Increment("edits", 1)}}},
+		{Locator: chat, FieldsToUpdate: FieldUpdates{Updates: []FieldUpdate{ArrayRemove("users", "b"), Increment("edits", 1)}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMerged := []FieldUpdate{ArrayRemove("users", "a", "b"), Increment("edits", 1)}
+	if len(merged) != 1 || !reflect.DeepEqual(merged[0].FieldsToUpdate.Updates, wantMerged) {
+		t.Errorf("got merged updates %+v, want %+v", merged, wantMerged)
+	}
+	_, _, err = normalizePlan([]DocumentUpdates{
+		{Locator: chat, FieldsToUpdate: FieldUpdates{Updates: []FieldUpdate{Set("settings", nil)}}},
+		{Locator: chat, FieldsToUpdate: FieldUpdates{Updates: []FieldUpdate{Set("settings.color", "red")}}},
+	}, nil)
+	var conflictErr *PlanConflictError
+	if !errors.As(err, &conflictErr) || conflictErr.Conflicts[0].Field != "settings.color" {
+		t.Errorf("got error %v, want a conflict on settings.color", err)
+	}
+}
@@ -1,8 +1,182 @@
 package pal
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
 const (
 	GET_DOCUMENT_ERROR     = "error getting document from data store:"
 	WRITE_BATCH_ERROR      = "error writing batch to data store:"
 	ACCESS_REQUEST_ERROR   = "error processing access request:"
 	DELETION_REQUEST_ERROR = "error processing deletion request:"
 )
+
+var (
+	// ErrDocumentNotFound is returned, wrapped, when a Document locator points
+	// to a document that does not exist.
+	ErrDocumentNotFound = errors.New("document does not exist")
+	// ErrInvalidLocator is matched by every *InvalidLocatorError.
+	ErrInvalidLocator = errors.New("invalid locator")
+	// ErrLimitExceeded is matched by every *LimitError.
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
+// TraversalError is returned when reading or handling a document fails while
+// a request traverses the data of its subject. Err is the error that occurred,
+// so errors.Is(err, ErrDocumentNotFound) tells a missing document from other
+// failures.
+type TraversalError struct {
+	// Locator is the locator being read, or that of the document being
+	// handled.
+	Locator  Locator
+	DataType string
+	// Path is the path from the data subject to Locator, in the form of
+	// LocatorProblem.Path.
+	Path string
+	Err  error
+}
+
+func (e *TraversalError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "data subject"
+	}
+	return fmt.Sprintf("%s (%s %s): %v", path, e.DataType, e.Locator.key(), e.Err)
+}
+
+func (e *TraversalError) Unwrap() error {
+	return e.Err
+}
+
+// traversalError returns err wrapped in a *TraversalError for loc at path,
+// unless it already is one or tells that the request was cancelled.
+func traversalError(loc Locator, path string, err error) error {
+	var traversalErr *TraversalError
+	if errors.As(err, &traversalErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return &TraversalError{Locator: loc, DataType: loc.DataType, Path: path, Err: err}
+}
+
+// LimitError is returned when a request exceeds one of its Limits.
+type LimitError struct {
+	// Limit is the name of the limit hit, e.g. MaxDepthLimit.
+	Limit string
+	// Max is the configured value of the limit.
+	Max int
+	// Locator is the locator being processed when the limit was hit.
+	Locator Locator
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded at %s", e.Limit, e.Max, e.Locator.key())
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// WriteError is returned by ProcessDeletionRequest when the writes of the
+// deletion plan could not all be applied. A deletion that returns a
+// WriteError has not been carried out, even if some writes were applied.
+type WriteError struct {
+	// Applied holds the locators of the deletions and updates that were
+	// written to the data store.
+	Applied []Locator
+	// NotApplied holds the locators of the deletions and updates that were
+	// not.
+	NotApplied []Locator
+	// Err is the error returned by the data store.
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	notApplied := make([]string, len(e.NotApplied))
+	for i, loc := range e.NotApplied {
+		notApplied[i] = loc.key()
+	}
+	return fmt.Sprintf("%d of %d writes applied, not applied: [%s]: %v",
+		len(e.Applied), len(e.Applied)+len(e.NotApplied), strings.Join(notApplied, ", "), e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// PlanConflictError is returned by ProcessDeletionRequest when HandleDeletion
+// asks for updates to the same document whose result would depend on the
+// order they are applied in, such as setting a field to two different values.
+type PlanConflictError struct {
+	Conflicts []UpdateConflict
+}
+
+// UpdateConflict is a field of a document that a deletion plan updates in
+// conflicting ways.
+type UpdateConflict struct {
+	Locator Locator
+	// Field is the dotted path of the field, which is equal to or nested in
+	// the field of the update it conflicts with.
+	Field string
+}
+
+func (e *PlanConflictError) Error() string {
+	conflicts := make([]string, len(e.Conflicts))
+	for i, conflict := range e.Conflicts {
+		conflicts[i] = fmt.Sprintf("%s of %s", conflict.Field, conflict.Locator.key())
+	}
+	return fmt.Sprintf("conflicting updates to %s", strings.Join(conflicts, ", "))
+}
+
+// StaleDocumentError is returned by ApplyDeletionPlan when documents changed
+// after the plan was made. Nothing is written in that case; build and approve
+// a new plan instead.
+type StaleDocumentError struct {
+	Locators []Locator
+}
+
+func (e *StaleDocumentError) Error() string {
+	locators := make([]string, len(e.Locators))
+	for i, loc := range e.Locators {
+		locators[i] = loc.key()
+	}
+	return fmt.Sprintf("documents changed since the deletion plan was made: %s", strings.Join(locators, ", "))
+}
+
+// InvalidLocatorError is returned when the data subject locator, or locators
+// a handler returns, cannot be read by the backend. The locators a handler
+// returns are all checked before any of them is read.
+type InvalidLocatorError struct {
+	Problems []LocatorProblem
+}
+
+// LocatorProblem is a problem with one locator.
+type LocatorProblem struct {
+	// Path tells where the locator came from. In access requests it is the
+	// path of its value in the report, such as "Groupchats[0].Messages". In
+	// deletion requests it is the path through the nodesToTraverse of each
+	// handler, such as "nodesToTraverse[0][2].nodesToTraverse[1]", where [2]
+	// is the third document read through a Collection locator. It is empty
+	// for the data subject locator.
+	Path    string
+	Locator Locator
+	Problem string
+}
+
+func (e *InvalidLocatorError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		path := problem.Path
+		if path == "" {
+			path = "data subject"
+		}
+		problems[i] = fmt.Sprintf("%s (%s %s): %s", path, problem.Locator.DataType, problem.Locator.key(), problem.Problem)
+	}
+	return fmt.Sprintf("invalid locators: %s", strings.Join(problems, "; "))
+}
+
+func (e *InvalidLocatorError) Is(target error) bool {
+	return target == ErrInvalidLocator
+}
@@ -0,0 +1,59 @@
+package pal
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	backend := newFriendsBackend(t)
+	if err := backend.Put("users/u3", map[string]interface{}{"name": "user3", "friends": []interface{}{"u9"}}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(backend)
+
+	_, err := client.ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1")
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("got error %v, want ErrDocumentNotFound", err)
+	}
+	var traversalErr *TraversalError
+	if !errors.As(err, &traversalErr) {
+		t.Fatalf("got error %v, want a *TraversalError", err)
+	}
+	if want := "Friends.u2.Friends.u3.Friends.u9"; traversalErr.Path != want || traversalErr.DataType != "user" || traversalErr.Locator.key() != "users/u9" {
+		t.Errorf("got %s (%s %s), want %s (user users/u9)", traversalErr.Path, traversalErr.DataType, traversalErr.Locator.key(), want)
+	}
+
+	_, err = client.ProcessAccessRequest(handleAccessFriends, friendsSubject("u0"), "u0")
+	if !errors.Is(err, ErrDocumentNotFound) || !errors.As(err, &traversalErr) || traversalErr.Path != "" {
+		t.Errorf("got error %v, want ErrDocumentNotFound for the data subject", err)
+	}
+
+	_, err = client.ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", WithLimits(Limits{MaxDepth: 1}))
+	if !errors.Is(err, ErrLimitExceeded) || errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("got error %v, want ErrLimitExceeded", err)
+	}
+
+	invalid := friendsSubject("u1")
+	invalid.DocIDs = nil
+	_, err = client.ProcessAccessRequest(handleAccessFriends, invalid, "u1")
+	if !errors.Is(err, ErrInvalidLocator) {
+		t.Errorf("got error %v, want ErrInvalidLocator", err)
+	}
+
+	handlerErr := errors.New("unknown chat")
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		if currentDbObjLocator.DataType == "chat" {
+			return nil, false, FieldUpdates{}, handlerErr
+		}
+		return handleDeletionFriends(dataSubjectId, currentDbObjLocator, dbObj)
+	}
+	_, err = client.ProcessDeletionRequestWithContext(context.Background(), handleDeletion, friendsSubject("u1"), "u1", true)
+	if !errors.Is(err, handlerErr) || !errors.As(err, &traversalErr) {
+		t.Fatalf("got error %v, want the handler error in a *TraversalError", err)
+	}
+	if want := "nodesToTraverse[0][0]"; traversalErr.Path != want || traversalErr.DataType != "chat" || traversalErr.Locator.key() != "chats/c1" {
+		t.Errorf("got %s (%s %s), want %s (chat chats/c1)", traversalErr.Path, traversalErr.DataType, traversalErr.Locator.key(), want)
+	}
+}
@@ -0,0 +1,75 @@
+package pal
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrorPolicy selects what an access request does when a document cannot be
+// read, such as one a dangling reference points to, or HandleAccess fails on
+// it. The data subject itself must always be read and handled. See
+// WithErrorPolicy.
+type ErrorPolicy struct {
+	// OnError applies to documents whose DataType is not in ByDataType.
+	OnError    ErrorAction
+	ByDataType map[string]ErrorAction
+}
+
+type ErrorAction int
+
+const (
+	// FailOnError makes the request return a *TraversalError.
+	FailOnError ErrorAction = iota
+	// SkipOnError leaves the document, or the collection that could not be
+	// read, out of the report.
+	SkipOnError
+	// PlaceholderOnError puts an object with ErrorKey as its only key in place
+	// of the document or collection.
+	PlaceholderOnError
+)
+
+// ErrorKey is the only key of the object that stands in for a part of an
+// access report left out because of an error, e.g.
+// {"$error": "error getting document from data store: document does not exist"}.
+const ErrorKey = "$error"
+
+// ErrorsKey is the key of the errors section of an access report. It is only
+// present if parts of the report were skipped or replaced under an
+// ErrorPolicy, and lists one object for each of them, with keys "path",
+// "dataType", "locator" and "error". "path" is in the form of
+// TraversalError.Path.
+const ErrorsKey = "$errors"
+
+// skippedNode takes the place of a part of the report left out under
+// SkipOnError until the report is assembled.
+type skippedNode struct{}
+
+func (p ErrorPolicy) action(dataType string) ErrorAction {
+	if action, ok := p.ByDataType[dataType]; ok {
+		return action
+	}
+	return p.OnError
+}
+
+// nodeFailed returns what takes the place of the part of the report at path
+// that loc could not provide because of err, or a *TraversalError if the
+// request fails on it. Cancelling the request always fails it.
+func (req *accessRequest) nodeFailed(loc Locator, path string, err error) (interface{}, error) {
+	action := req.errorPolicy.action(loc.DataType)
+	if action == FailOnError || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil, traversalError(loc, path, err)
+	}
+	// another occurrence of the document fails again instead of referring
+	// to a part of the report that is missing
+	delete(req.visited, handleKey(loc))
+	req.failures = append(req.failures, map[string]interface{}{
+		"path":     path,
+		"dataType": loc.DataType,
+		"locator":  loc.key(),
+		"error":    err.Error(),
+	})
+	if action == SkipOnError {
+		return skippedNode{}, nil
+	}
+	return map[string]interface{}{ErrorKey: err.Error()}, nil
+}
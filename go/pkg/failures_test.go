@@ -0,0 +1,92 @@
+package pal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorPolicy(t *testing.T) {
+	newBackend := func(t *testing.T) *MemoryBackend {
+		backend := newFriendsBackend(t)
+		if err := backend.Put("users/u1", map[string]interface{}{"name": "user1", "friends": []interface{}{"u2", "u9"}}); err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	}
+	chatErr := errors.New("unknown chat")
+	handleAccess := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+		if currentDbObjLocator.DataType == "chat" {
+			return nil, chatErr
+		}
+		return handleAccessFriends(dataSubjectId, currentDbObjLocator, dbObj)
+	}
+	missing := "error getting document from data store: document does not exist"
+	failures := []interface{}{
+		map[string]interface{}{"path": "Chats[0]", "dataType": "chat", "locator": "chats/c1", "error": "unknown chat"},
+		map[string]interface{}{"path": "Friends.u2.Chats[0]", "dataType": "chat", "locator": "chats/c1", "error": "unknown chat"},
+		map[string]interface{}{"path": "Friends.u9", "dataType": "user", "locator": "users/u9", "error": missing},
+	}
+	user3 := map[string]interface{}{"Name": "user3", "Friends": map[string]interface{}{}, "Chats": []interface{}(nil), DataTypeKey: "user"}
+
+	tests := []struct {
+		name   string
+		policy ErrorPolicy
+		want   map[string]interface{}
+	}{
+		{
+			"skip",
+			ErrorPolicy{OnError: SkipOnError},
+			map[string]interface{}{
+				"Name":  "user1",
+				"Chats": []interface{}(nil),
+				"Friends": map[string]interface{}{
+					"u2": map[string]interface{}{
+						"Name":      "user2",
+						"Chats":     []interface{}(nil),
+						"Friends":   map[string]interface{}{"u1": reference("users/u1"), "u3": user3},
+						DataTypeKey: "user",
+					},
+				},
+				ErrorsKey:   failures,
+				DataTypeKey: "user",
+			},
+		},
+		{
+			"placeholder per data type",
+			ErrorPolicy{OnError: SkipOnError, ByDataType: map[string]ErrorAction{"user": PlaceholderOnError}},
+			map[string]interface{}{
+				"Name":  "user1",
+				"Chats": []interface{}(nil),
+				"Friends": map[string]interface{}{
+					"u2": map[string]interface{}{
+						"Name":      "user2",
+						"Chats":     []interface{}(nil),
+						"Friends":   map[string]interface{}{"u1": reference("users/u1"), "u3": user3},
+						DataTypeKey: "user",
+					},
+					"u9": map[string]interface{}{ErrorKey: missing},
+				},
+				ErrorsKey:   failures,
+				DataTypeKey: "user",
+			},
+		},
+	}
+	for _, tt := range tests {
+		for _, opts := range [][]RequestOption{nil, {WithConcurrency(4)}} {
+			report, err := NewClient(newBackend(t)).ProcessAccessRequest(handleAccess, friendsSubject("u1"), "u1", append(opts, WithErrorPolicy(tt.policy))...)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if !reflect.DeepEqual(report, tt.want) {
+				t.Errorf("%s: got report %v, want %v", tt.name, report, tt.want)
+			}
+		}
+	}
+
+	policy := ErrorPolicy{OnError: SkipOnError, ByDataType: map[string]ErrorAction{"chat": FailOnError}}
+	_, err := NewClient(newBackend(t)).ProcessAccessRequest(handleAccess, friendsSubject("u1"), "u1", WithErrorPolicy(policy))
+	if !errors.Is(err, chatErr) {
+		t.Errorf("got error %v, want the chat handler to fail the request", err)
+	}
+}
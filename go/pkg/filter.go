@@ -0,0 +1,123 @@
+package pal
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoFilterOperators maps the operators of Filter to MongoDB query
+// operators. array-contains and array-contains-any are wrapped in $elemMatch
+// so that, as in Firestore, they only match array fields.
+var mongoFilterOperators = map[string]string{
+	"==":                 "$eq",
+	"!=":                 "$ne",
+	"<":                  "$lt",
+	"<=":                 "$lte",
+	">":                  "$gt",
+	">=":                 "$gte",
+	"in":                 "$in",
+	"not-in":             "$nin",
+	"array-contains":     "$eq",
+	"array-contains-any": "$in",
+}
+
+// firestoreFilterOperators are the operators of Filter that Firestore
+// understands.
+var firestoreFilterOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"in": true, "not-in": true, "array-contains": true, "array-contains-any": true,
+}
+
+// mongoFilter translates filters into a MongoDB query, such as
+// {age: {$gte: 18, $lt: 65}} for two filters on "age". Every filter must hold;
+// if two filters on the same field use the same operator, the second one is
+// added to an $and clause. As in Firestore, != and not-in only match documents
+// that have the field, so they also get {$exists: true}.
+func mongoFilter(filters []Filter) (bson.D, error) {
+	var query bson.D
+	var and bson.A
+	for _, filter := range filters {
+		operator, ok := mongoFilterOperators[filter.Op]
+		if !ok {
+			return nil, fmt.Errorf("filter operator %q on %s is not supported in MongoDB", filter.Op, filter.Path)
+		}
+		value := filter.Value
+		switch filter.Op {
+		case "in", "not-in", "array-contains-any":
+			values, ok := toSlice(value)
+			if !ok {
+				return nil, fmt.Errorf("filter %q on %s needs a slice value", filter.Op, filter.Path)
+			}
+			value = bson.A(values)
+		}
+		condition := bson.E{Key: operator, Value: value}
+		if filter.Op == "array-contains" || filter.Op == "array-contains-any" {
+			condition = bson.E{Key: "$elemMatch", Value: bson.D{condition}}
+		}
+		conditions := bson.D{condition}
+		if filter.Op == "!=" || filter.Op == "not-in" {
+			conditions = bson.D{{Key: "$exists", Value: true}, condition}
+		}
+
+		i := 0
+		for i < len(query) && query[i].Key != filter.Path {
+			i++
+		}
+		if i == len(query) {
+			query = append(query, bson.E{Key: filter.Path, Value: conditions})
+			continue
+		}
+		existing := query[i].Value.(bson.D)
+		if hasKey(existing, condition.Key) {
+			and = append(and, bson.D{{Key: filter.Path, Value: conditions}})
+			continue
+		}
+		for _, c := range conditions {
+			if !hasKey(existing, c.Key) {
+				existing = append(existing, c)
+			}
+		}
+		query[i].Value = existing
+	}
+	if len(and) > 0 {
+		query = append(query, bson.E{Key: "$and", Value: and})
+	}
+	return query, nil
+}
+
+func hasKey(doc bson.D, key string) bool {
+	for _, e := range doc {
+		if e.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// query returns the MongoDB query l stands for: Filter, with the translation
+// of Where added to it.
+func (l MongoLocator) query() (bson.D, error) {
+	if len(l.Where) == 0 {
+		return l.Filter, nil
+	}
+	where, err := mongoFilter(l.Where)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Filter) == 0 {
+		return where, nil
+	}
+	return bson.D{{Key: "$and", Value: bson.A{l.Filter, where}}}, nil
+}
+
+// checkFirestoreFilters returns an error if a filter uses an operator that
+// Firestore does not understand.
+func checkFirestoreFilters(filters []Filter) error {
+	for _, filter := range filters {
+		if !firestoreFilterOperators[filter.Op] {
+			return fmt.Errorf("filter operator %q on %s is not supported in Firestore", filter.Op, filter.Path)
+		}
+	}
+	return nil
+}
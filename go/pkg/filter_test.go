@@ -0,0 +1,131 @@
+package pal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMongoFilter(t *testing.T) {
+	tests := []struct {
+		filters []Filter
+		want    bson.D
+	}{
+		{[]Filter{{Path: "name", Op: "==", Value: "a"}}, bson.D{{Key: "name", Value: bson.D{{Key: "$eq", Value: "a"}}}}},
+		{[]Filter{{Path: "name", Op: "!=", Value: "a"}}, bson.D{{Key: "name", Value: bson.D{{Key: "$exists", Value: true}, {Key: "$ne", Value: "a"}}}}},
+		{
+			[]Filter{{Path: "age", Op: ">=", Value: 18}, {Path: "age", Op: "<", Value: 65}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: 18}, {Key: "$lt", Value: 65}}}},
+		},
+		{
+			[]Filter{{Path: "age", Op: ">", Value: 1}, {Path: "age", Op: "<=", Value: 2}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 1}, {Key: "$lte", Value: 2}}}},
+		},
+		{[]Filter{{Path: "tag", Op: "in", Value: []string{"a", "b"}}}, bson.D{{Key: "tag", Value: bson.D{{Key: "$in", Value: bson.A{"a", "b"}}}}}},
+		{[]Filter{{Path: "tag", Op: "not-in", Value: []interface{}{"a"}}}, bson.D{{Key: "tag", Value: bson.D{{Key: "$exists", Value: true}, {Key: "$nin", Value: bson.A{"a"}}}}}},
+		{
+			[]Filter{{Path: "n", Op: "!=", Value: 1}, {Path: "n", Op: "not-in", Value: []int{2}}},
+			bson.D{{Key: "n", Value: bson.D{{Key: "$exists", Value: true}, {Key: "$ne", Value: 1}, {Key: "$nin", Value: bson.A{2}}}}},
+		},
+		{
+			[]Filter{{Path: "users", Op: "array-contains", Value: "u1"}},
+			bson.D{{Key: "users", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$eq", Value: "u1"}}}}}},
+		},
+		{
+			[]Filter{{Path: "users", Op: "array-contains-any", Value: []string{"u1", "u2"}}},
+			bson.D{{Key: "users", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$in", Value: bson.A{"u1", "u2"}}}}}}},
+		},
+		{
+			[]Filter{{Path: "users", Op: "array-contains", Value: "u1"}, {Path: "users", Op: "array-contains", Value: "u2"}},
+			bson.D{
+				{Key: "users", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$eq", Value: "u1"}}}}},
+				{Key: "$and", Value: bson.A{bson.D{{Key: "users", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$eq", Value: "u2"}}}}}}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := mongoFilter(tt.filters)
+		if err != nil {
+			t.Errorf("mongoFilter(%v): %v", tt.filters, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mongoFilter(%v) = %v, want %v", tt.filters, got, tt.want)
+		}
+	}
+
+	for _, filters := range [][]Filter{
+		{{Path: "name", Op: "like", Value: "a%"}},
+		{{Path: "tag", Op: "in", Value: "a"}},
+		{{Path: "users", Op: "array-contains-any", Value: 1}},
+	} {
+		if _, err := mongoFilter(filters); err == nil {
+			t.Errorf("mongoFilter(%v): got no error", filters)
+		}
+	}
+}
+
+func TestMongoLocatorWhere(t *testing.T) {
+	docs := map[string]map[string]interface{}{
+		"items/a": {"n": int64(1), "tags": []interface{}{"red", "blue"}, "kind": "x"},
+		"items/b": {"n": int64(2), "tags": []interface{}{"green"}, "kind": "y"},
+		"items/c": {"n": int64(3), "tags": []interface{}{"blue"}, "kind": "z"},
+		// no n or kind: excluded by != and not-in in Firestore
+		"items/d": {"tags": []interface{}{"red"}},
+	}
+	firestoreBackend := NewMemoryBackend(FirestoreStyle)
+	mongoBackend := NewMemoryBackend(MongoStyle)
+	for path, doc := range docs {
+		for _, backend := range []*MemoryBackend{firestoreBackend, mongoBackend} {
+			if err := backend.Put(path, doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	ids := func(backend *MemoryBackend, loc Locator) []interface{} {
+		locAndObjs, err := backend.GetDocuments(context.Background(), loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []interface{}
+		for _, locAndObj := range locAndObjs {
+			ids = append(ids, locAndObj.Object["_id"])
+		}
+		return ids
+	}
+
+	for _, filters := range [][]Filter{
+		{{Path: "n", Op: "==", Value: int64(2)}},
+		{{Path: "n", Op: "!=", Value: int64(2)}},
+		{{Path: "n", Op: ">", Value: int64(1)}, {Path: "n", Op: "<=", Value: int64(3)}},
+		{{Path: "n", Op: "<", Value: int64(3)}, {Path: "n", Op: ">=", Value: int64(2)}},
+		{{Path: "kind", Op: "in", Value: []string{"x", "z"}}},
+		{{Path: "kind", Op: "not-in", Value: []string{"x", "z"}}},
+		{{Path: "tags", Op: "array-contains", Value: "blue"}},
+		{{Path: "tags", Op: "array-contains-any", Value: []string{"green", "red"}}},
+		{{Path: "tags", Op: "array-contains", Value: "blue"}, {Path: "tags", Op: "array-contains", Value: "red"}},
+	} {
+		firestoreLoc := Locator{LocatorType: Collection, DataType: "item", FirestoreLocator: FirestoreLocator{CollectionPath: []string{"items"}, Filters: filters}}
+		mongoLoc := Locator{LocatorType: Collection, DataType: "item", MongoLocator: MongoLocator{Collection: "items", Where: filters}}
+		want := ids(firestoreBackend, firestoreLoc)
+		if got := ids(mongoBackend, mongoLoc); !reflect.DeepEqual(got, want) {
+			t.Errorf("filters %v: got %v in MongoDB, want %v as in Firestore", filters, got, want)
+		}
+	}
+
+	combined := Locator{LocatorType: Collection, MongoLocator: MongoLocator{
+		Collection: "items",
+		Filter:     bson.D{{Key: "kind", Value: "x"}},
+		Where:      []Filter{{Path: "n", Op: ">", Value: int64(0)}},
+	}}
+	if got := ids(mongoBackend, combined); !reflect.DeepEqual(got, []interface{}{"a"}) {
+		t.Errorf("got %v, want [a] matching both Filter and Where", got)
+	}
+	unsupported := Locator{LocatorType: Collection, MongoLocator: MongoLocator{Collection: "items", Where: []Filter{{Path: "n", Op: "~", Value: 1}}}}
+	if _, err := mongoBackend.GetDocuments(context.Background(), unsupported); err == nil {
+		t.Error("got no error for an unsupported operator")
+	}
+}
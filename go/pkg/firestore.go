@@ -2,47 +2,104 @@ package pal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// FirestoreMaxTransactionWrites is the largest number of writes Firestore
+// accepts in a single transaction. Pass it to WithBatchSize to delete data
+// subjects with more documents than that.
+const FirestoreMaxTransactionWrites = 500
+
 type firestoreClient struct {
 	client *firestore.Client
 }
 
-func newDbClientForFirestore(client *firestore.Client) databaseClient {
+func newDbClientForFirestore(client *firestore.Client) Backend {
 	return &firestoreClient{client: client}
 }
 
-func (c *firestoreClient) getDocument(loc Locator) (locatorAndObject, error) {
-	docRef := c.client.Collection(loc.FirestoreLocator.CollectionPath[0]).Doc(loc.DocIDs[0])
+func (c *firestoreClient) GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	doc, err := c.docRef(loc).Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+	if !doc.Exists() {
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, ErrDocumentNotFound)
+	}
 
-	for i := 1; i < len(loc.FirestoreLocator.CollectionPath); i++ {
-		docRef = docRef.Collection(loc.FirestoreLocator.CollectionPath[i]).Doc(loc.DocIDs[i])
+	data := doc.Data()
+	data["_id"] = doc.Ref.ID
+	return LocatorAndObject{Locator: loc, Object: data, Fingerprint: firestoreFingerprint(doc)}, nil
+}
+
+// ResolveReference turns the reference of loc into a FirestoreLocator with the
+// same path.
+func (c *firestoreClient) ResolveReference(loc Locator) (Locator, error) {
+	return loc.resolveFirestore()
+}
+
+// Name returns "firestore".
+func (c *firestoreClient) Name() string {
+	return "firestore"
+}
+
+// ValidateLocator checks that loc has a valid FirestoreLocator.
+func (c *firestoreClient) ValidateLocator(loc Locator) []string {
+	return firestoreLocatorProblems(loc)
+}
+
+// GetAll reads all documents with a single BatchGetDocuments call.
+func (c *firestoreClient) GetAll(ctx context.Context, locs []Locator) ([]LocatorAndObject, error) {
+	docRefs := make([]*firestore.DocumentRef, len(locs))
+	for i, loc := range locs {
+		docRefs[i] = c.docRef(loc)
 	}
 
-	doc, err := docRef.Get(context.Background())
+	docs, err := c.client.GetAll(ctx, docRefs)
 	if err != nil {
-		return locatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
 	}
-	if !doc.Exists() {
-		return locatorAndObject{}, fmt.Errorf("%s document does not exist", GET_DOCUMENT_ERROR)
+
+	results := make([]LocatorAndObject, len(docs))
+	for i, doc := range docs {
+		if !doc.Exists() {
+			return nil, fmt.Errorf("%s %s: %w", GET_DOCUMENT_ERROR, locs[i].key(), ErrDocumentNotFound)
+		}
+		data := doc.Data()
+		data["_id"] = doc.Ref.ID
+		loc := locs[i]
+		loc.LocatorType = Document
+		results[i] = LocatorAndObject{Locator: loc, Object: data, Fingerprint: firestoreFingerprint(doc)}
 	}
+	return results, nil
+}
 
-	data := doc.Data()
-	data["_id"] = doc.Ref.ID
-	return locatorAndObject{Locator: loc, Object: data}, nil
+// docRef returns the reference to the document a Document locator points to.
+func (c *firestoreClient) docRef(loc Locator) *firestore.DocumentRef {
+	docRef := c.client.Collection(loc.FirestoreLocator.CollectionPath[0]).Doc(loc.DocIDs[0])
+
+	for i := 1; i < len(loc.FirestoreLocator.CollectionPath); i++ {
+		docRef = docRef.Collection(loc.FirestoreLocator.CollectionPath[i]).Doc(loc.DocIDs[i])
+	}
+	return docRef
 }
 
-func (c *firestoreClient) getDocuments(loc Locator) ([]locatorAndObject, error) {
+func (c *firestoreClient) GetDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
 	docRef := c.client.Collection(loc.FirestoreLocator.CollectionPath[0])
 
 	for i := 1; i < len(loc.FirestoreLocator.CollectionPath); i++ {
 		docRef = docRef.Doc(loc.DocIDs[i-1]).Collection(loc.FirestoreLocator.CollectionPath[i])
 	}
 
+	if err := checkFirestoreFilters(loc.Filters); err != nil {
+		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
 	var query firestore.Query = docRef.Query
 	if len(loc.Filters) > 0 {
 		query = docRef.Where(loc.Filters[0].Path, loc.Filters[0].Op, loc.Filters[0].Value)
@@ -51,38 +108,40 @@ func (c *firestoreClient) getDocuments(loc Locator) ([]locatorAndObject, error)
 		}
 	}
 
-	docs, err := query.Documents(context.Background()).GetAll()
+	if limit := FetchLimit(ctx); limit > 0 {
+		query = query.Limit(limit)
+	}
+
+	docs, err := query.Documents(ctx).GetAll()
 
 	if err != nil {
 		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
 	}
 
-	dataNodes := make([]locatorAndObject, len(docs))
+	dataNodes := make([]LocatorAndObject, len(docs))
 	for i, d := range docs {
 		data := d.Data()
 		data["_id"] = d.Ref.ID
 		newLoc := Locator{
 			LocatorType: Document,
 			DataType:    loc.DataType,
+			Context:     loc.Context,
 			FirestoreLocator: FirestoreLocator{
 				CollectionPath: loc.FirestoreLocator.CollectionPath,
-				DocIDs:         append(loc.DocIDs, d.Ref.ID),
+				// copy so that sibling locators do not share a backing array
+				DocIDs: append(append([]string{}, loc.DocIDs...), d.Ref.ID),
 			},
 		}
-		dataNodes[i] = locatorAndObject{Locator: newLoc, Object: data}
+		dataNodes[i] = LocatorAndObject{Locator: newLoc, Object: data, Fingerprint: firestoreFingerprint(d)}
 	}
 	return dataNodes, nil
 }
 
-func (c *firestoreClient) updateAndDelete(documentsToUpdate []documentUpdates, nodesToDelete []Locator) {
-	err := c.client.RunTransaction(context.Background(), func(ctx context.Context, t *firestore.Transaction) error {
+func (c *firestoreClient) UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	err := c.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
 		// delete nodes
 		for _, nodeLocator := range nodesToDelete {
-			docRef := c.client.Collection(nodeLocator.FirestoreLocator.CollectionPath[0]).Doc(nodeLocator.DocIDs[0])
-
-			for i := 1; i < len(nodeLocator.FirestoreLocator.CollectionPath); i++ {
-				docRef = docRef.Collection(nodeLocator.FirestoreLocator.CollectionPath[i]).Doc(nodeLocator.DocIDs[i])
-			}
+			docRef := c.docRef(nodeLocator)
 
 			err := t.Delete(docRef)
 			if err != nil {
@@ -92,13 +151,16 @@ func (c *firestoreClient) updateAndDelete(documentsToUpdate []documentUpdates, n
 
 		// update nodes
 		for _, update := range documentsToUpdate {
-			docRef := c.client.Collection(update.Locator.FirestoreLocator.CollectionPath[0]).Doc(update.Locator.DocIDs[0])
+			docRef := c.docRef(update.Locator)
 
-			for i := 1; i < len(update.Locator.FirestoreLocator.CollectionPath); i++ {
-				docRef = docRef.Collection(update.Locator.FirestoreLocator.CollectionPath[i]).Doc(update.Locator.DocIDs[i])
+			firestoreUpdates, err := update.FieldsToUpdate.firestoreUpdates()
+			if err != nil {
+				return err
 			}
-
-			err := t.Update(docRef, update.FieldsToUpdate.FirestoreUpdates)
+			if len(firestoreUpdates) == 0 {
+				continue
+			}
+			err = t.Update(docRef, firestoreUpdates)
 			if err != nil {
 				return err
 			}
@@ -108,6 +170,82 @@ func (c *firestoreClient) updateAndDelete(documentsToUpdate []documentUpdates, n
 	})
 
 	if err != nil {
-		log.Printf("Error updating and deleting data: %v", err)
+		return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
+	}
+	return nil
+}
+
+// Fingerprint returns the update time of the document loc points to.
+func (c *firestoreClient) Fingerprint(ctx context.Context, loc Locator) (string, error) {
+	doc, err := c.docRef(loc).Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return "", fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+	if !doc.Exists() {
+		return "", fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, ErrDocumentNotFound)
+	}
+	return firestoreFingerprint(doc), nil
+}
+
+func firestoreFingerprint(doc *firestore.DocumentSnapshot) string {
+	return doc.UpdateTime.UTC().Format(time.RFC3339Nano)
+}
+
+// UpdateAndDeleteIfUnchanged reads every document in the transaction to tell
+// which ones changed, and writes each with a LastUpdateTime precondition, so
+// that a document changed after the check makes the transaction fail too.
+func (c *firestoreClient) UpdateAndDeleteIfUnchanged(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator, fingerprints map[string]string) error {
+	err := c.client.RunTransaction(ctx, func(ctx context.Context, t *firestore.Transaction) error {
+		locs := writeLocators(documentsToUpdate, nodesToDelete)
+		docRefs := make([]*firestore.DocumentRef, len(locs))
+		for i, loc := range locs {
+			docRefs[i] = c.docRef(loc)
+		}
+		docs, err := t.GetAll(docRefs)
+		if err != nil {
+			return err
+		}
+
+		updateTimes := make(map[string]time.Time, len(locs))
+		var stale []Locator
+		for i, doc := range docs {
+			key := locs[i].key()
+			if !doc.Exists() || firestoreFingerprint(doc) != fingerprints[key] {
+				stale = append(stale, locs[i])
+				continue
+			}
+			updateTimes[key] = doc.UpdateTime
+		}
+		if len(stale) > 0 {
+			return &StaleDocumentError{Locators: stale}
+		}
+
+		for _, nodeLocator := range nodesToDelete {
+			if err := t.Delete(c.docRef(nodeLocator), firestore.LastUpdateTime(updateTimes[nodeLocator.key()])); err != nil {
+				return err
+			}
+		}
+		for _, update := range documentsToUpdate {
+			firestoreUpdates, err := update.FieldsToUpdate.firestoreUpdates()
+			if err != nil {
+				return err
+			}
+			if len(firestoreUpdates) == 0 {
+				continue
+			}
+			if err := t.Update(c.docRef(update.Locator), firestoreUpdates, firestore.LastUpdateTime(updateTimes[update.Locator.key()])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	var staleErr *StaleDocumentError
+	if errors.As(err, &staleErr) {
+		return staleErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
 	}
+	return nil
 }
@@ -0,0 +1,132 @@
+package pal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Limits bound the work a single request may do, so that a handler returning
+// an overly broad locator cannot pull a whole collection into memory. A zero
+// field means no limit.
+type Limits struct {
+	// MaxDepth is the maximum number of locators followed from the data subject
+	// down to a document. The data subject is at depth 0, documents it links
+	// to are at depth 1, and so on.
+	MaxDepth int
+	// MaxDocuments is the maximum number of documents read, including the data
+	// subject.
+	MaxDocuments int
+	// MaxReportBytes is the maximum size of the values in an access report,
+	// measured by their JSON encoding. Deletion requests ignore it.
+	MaxReportBytes int
+	// OnLimit selects what an access request does when a limit is hit.
+	// Deletion requests always fail, since a partial deletion plan would leave
+	// personal data behind without saying so.
+	OnLimit LimitAction
+}
+
+type LimitAction int
+
+const (
+	// FailOnLimit makes the request return a *LimitError.
+	FailOnLimit LimitAction = iota
+	// TruncateOnLimit puts a note under TruncatedKey in place of every part of
+	// the access report that was left out, and returns the rest of the report.
+	TruncateOnLimit
+)
+
+// TruncatedKey is the only key of the object that stands in for a part of an
+// access report left out because of a limit, e.g.
+// {"$truncated": "MaxDepth limit of 3 exceeded at users/123"}.
+const TruncatedKey = "$truncated"
+
+const (
+	MaxDepthLimit       = "MaxDepth"
+	MaxDocumentsLimit   = "MaxDocuments"
+	MaxReportBytesLimit = "MaxReportBytes"
+)
+
+type fetchLimitKey struct{}
+
+// FetchLimit returns the maximum number of documents GetDocuments needs to
+// return for the request ctx belongs to, or 0 if there is no such limit.
+// Requests with Limits.MaxDocuments set attach it to the context so that
+// backends can stop reading early. Returning more documents is allowed, but
+// wastes work.
+func FetchLimit(ctx context.Context) int {
+	limit, _ := ctx.Value(fetchLimitKey{}).(int)
+	return limit
+}
+
+func withFetchLimit(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, fetchLimitKey{}, limit)
+}
+
+// limitTracker counts the documents and report bytes used by a request.
+type limitTracker struct {
+	limits      Limits
+	documents   int
+	reportBytes int
+}
+
+// checkDepth returns an error if a document at depth may not be read.
+func (t *limitTracker) checkDepth(depth int, loc Locator) error {
+	if t.limits.MaxDepth > 0 && depth > t.limits.MaxDepth {
+		return &LimitError{Limit: MaxDepthLimit, Max: t.limits.MaxDepth, Locator: loc}
+	}
+	return nil
+}
+
+// addDocuments records that n more documents were read and returns how many
+// of them fit within MaxDocuments, along with an error if not all of them do.
+func (t *limitTracker) addDocuments(n int, loc Locator) (int, error) {
+	if t.limits.MaxDocuments > 0 && t.documents+n > t.limits.MaxDocuments {
+		allowed := t.limits.MaxDocuments - t.documents
+		t.documents = t.limits.MaxDocuments
+		return allowed, &LimitError{Limit: MaxDocumentsLimit, Max: t.limits.MaxDocuments, Locator: loc}
+	}
+	t.documents += n
+	return n, nil
+}
+
+// documentsLeft returns how many more documents may be read, and false if
+// there is no MaxDocuments limit.
+func (t *limitTracker) documentsLeft() (int, bool) {
+	if t.limits.MaxDocuments == 0 {
+		return 0, false
+	}
+	return t.limits.MaxDocuments - t.documents, true
+}
+
+// fetchContext returns ctx carrying the number of documents GetDocuments
+// needs to return to tell whether MaxDocuments is exceeded.
+func (t *limitTracker) fetchContext(ctx context.Context) context.Context {
+	if t.limits.MaxDocuments == 0 {
+		return ctx
+	}
+	return withFetchLimit(ctx, t.limits.MaxDocuments-t.documents+1)
+}
+
+// addReportValue records that value is added to the report under key, and
+// returns an error if that exceeds MaxReportBytes.
+func (t *limitTracker) addReportValue(key string, value interface{}, loc Locator) error {
+	if t.limits.MaxReportBytes == 0 {
+		return nil
+	}
+	size := len(key) + 4 // quotes, colon and comma
+	if encoded, err := json.Marshal(value); err == nil {
+		size += len(encoded)
+	} else {
+		size += len(fmt.Sprint(value))
+	}
+	if t.reportBytes+size > t.limits.MaxReportBytes {
+		return &LimitError{Limit: MaxReportBytesLimit, Max: t.limits.MaxReportBytes, Locator: loc}
+	}
+	t.reportBytes += size
+	return nil
+}
+
+func truncated(err *LimitError) map[string]interface{} {
+	return map[string]interface{}{TruncatedKey: err.Error()}
+}
@@ -0,0 +1,113 @@
+package pal
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func friendsSubject(id string) Locator {
+	return Locator{
+		LocatorType:      Document,
+		DataType:         "user",
+		FirestoreLocator: FirestoreLocator{CollectionPath: []string{"users"}, DocIDs: []string{id}},
+	}
+}
+
+func TestAccessRequestLimitsFail(t *testing.T) {
+	client := NewClient(newFriendsBackend(t))
+
+	tests := []struct {
+		limits Limits
+		want   string
+	}{
+		{Limits{MaxDepth: 1}, MaxDepthLimit},
+		{Limits{MaxDocuments: 3}, MaxDocumentsLimit},
+		{Limits{MaxReportBytes: 20}, MaxReportBytesLimit},
+	}
+	for _, tt := range tests {
+		_, err := client.ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", WithLimits(tt.limits))
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%+v: got error %v, want a *LimitError", tt.limits, err)
+			continue
+		}
+		if limitErr.Limit != tt.want {
+			t.Errorf("%+v: got limit %s, want %s", tt.limits, limitErr.Limit, tt.want)
+		}
+	}
+}
+
+func TestAccessRequestLimitsTruncate(t *testing.T) {
+	client := NewClient(newFriendsBackend(t))
+
+	report, err := client.ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", WithLimits(Limits{MaxDepth: 1, OnLimit: TruncateOnLimit}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	depthNote := func(key string) map[string]interface{} {
+		return map[string]interface{}{TruncatedKey: "MaxDepth limit of 1 exceeded at " + key}
+	}
+	want := map[string]interface{}{
+		"Name":  "user1",
+		"Chats": []interface{}{map[string]interface{}{"Title": "shared", DataTypeKey: "chat"}},
+		"Friends": map[string]interface{}{
+			"u2": map[string]interface{}{
+				"Name":  "user2",
+				"Chats": depthNote("chats"),
+				"Friends": map[string]interface{}{
+					"u1": reference("users/u1"),
+					"u3": depthNote("users/u3"),
+				},
+				DataTypeKey: "user",
+			},
+			"u3": map[string]interface{}{
+				"Name":      "user3",
+				"Chats":     depthNote("chats"),
+				"Friends":   map[string]interface{}{},
+				DataTypeKey: "user",
+			},
+		},
+		DataTypeKey: "user",
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %v, want %v", report, want)
+	}
+
+	report, err = client.ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", WithLimits(Limits{MaxDocuments: 2, OnLimit: TruncateOnLimit}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	documentsNote := func(key string) map[string]interface{} {
+		return map[string]interface{}{TruncatedKey: "MaxDocuments limit of 2 exceeded at " + key}
+	}
+	want = map[string]interface{}{
+		"Name":  "user1",
+		"Chats": []interface{}{map[string]interface{}{"Title": "shared", DataTypeKey: "chat"}},
+		"Friends": map[string]interface{}{
+			"u2": documentsNote("users/u2"),
+			"u3": documentsNote("users/u3"),
+		},
+		DataTypeKey: "user",
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %v, want %v", report, want)
+	}
+}
+
+func TestDeletionRequestLimits(t *testing.T) {
+	backend := newFriendsBackend(t)
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		var friends []Locator
+		for _, id := range dbObj["friends"].([]interface{}) {
+			friends = append(friends, friendsSubject(id.(string)))
+		}
+		return friends, false, FieldUpdates{}, nil
+	}
+
+	_, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, friendsSubject("u1"), "u1", true, WithLimits(Limits{MaxDepth: 3, OnLimit: TruncateOnLimit}))
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != MaxDepthLimit {
+		t.Fatalf("got error %v, want a MaxDepth *LimitError", err)
+	}
+}
@@ -2,6 +2,7 @@ package pal
 
 import (
 	"fmt"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
 )
@@ -12,6 +13,18 @@ type Locator struct {
 	// Only one of FirestoreLocator and MongoLocator should be set
 	FirestoreLocator
 	MongoLocator
+	// Context is optional metadata a handler passes along with a locator, such
+	// as how the document was reached, to the handler of the documents it
+	// points to. It is kept on the locators of documents read through a
+	// Collection locator. Use plain values (maps, slices, strings, numbers,
+	// booleans) so that it can be stored in deletion plans. Access requests
+	// expand a document once per DataType and Context, but never again while
+	// it is already being expanded with the same DataType, whatever the
+	// Context: such a locator is a cycle and yields a ReferenceKey object.
+	Context interface{}
+	// Ref, if set, is resolved into FirestoreLocator or MongoLocator by the
+	// backend before the locator is used. See Reference.
+	Ref *Reference `json:"-"`
 }
 
 type LocatorType string
@@ -31,6 +44,10 @@ type FirestoreLocator struct {
 	Filters []Filter
 }
 
+// Filter is a condition on a document field, with the operators of Firestore:
+// ==, !=, <, <=, >, >=, in, not-in, array-contains and array-contains-any. A
+// document without the field matches none of them, not even != and not-in, in
+// both Firestore and MongoDB.
 type Filter struct {
 	Path  string
 	Op    string
@@ -40,17 +57,141 @@ type Filter struct {
 type MongoLocator struct {
 	Collection string
 	Filter     bson.D
+	// Where holds filters in the form FirestoreLocator uses. They are
+	// translated into MongoDB query operators and must hold along with Filter.
+	Where []Filter
 }
 
-func validateLocator(loc Locator) error {
-	if len(loc.FirestoreLocator.CollectionPath) == 0 {
-		return fmt.Errorf("collection path must have at least one element")
+// locatorProblems returns every problem that keeps backend from reading loc:
+// those common to all backends, followed by those its LocatorValidator finds.
+func locatorProblems(backend Backend, loc Locator) []string {
+	var problems []string
+	if loc.LocatorType != Document && loc.LocatorType != Collection {
+		problems = append(problems, fmt.Sprintf("locator type must be %q or %q, got %q", Document, Collection, loc.LocatorType))
 	}
-	if loc.LocatorType == Document && len(loc.DocIDs) != len(loc.FirestoreLocator.CollectionPath) {
-		return fmt.Errorf("document locator must have the same number of docIDs as collection path elements")
+	if loc.hasFirestoreLocator() && loc.hasMongoLocator() {
+		problems = append(problems, "only one of FirestoreLocator and MongoLocator may be set")
 	}
-	if loc.LocatorType == Collection && len(loc.DocIDs) != len(loc.FirestoreLocator.CollectionPath)-1 {
-		return fmt.Errorf("collection locator must have one less docID than collection path elements")
+	if validator, ok := backend.(LocatorValidator); ok {
+		problems = append(problems, validator.ValidateLocator(loc)...)
+	}
+	return problems
+}
+
+// checkLocators returns an *InvalidLocatorError listing the problems of locs,
+// found at the given paths, or nil if backend can read all of them.
+func checkLocators(backend Backend, paths []string, locs []Locator) error {
+	var problems []LocatorProblem
+	for i, loc := range locs {
+		for _, problem := range locatorProblems(backend, loc) {
+			problems = append(problems, LocatorProblem{Path: paths[i], Locator: loc, Problem: problem})
+		}
+	}
+	if len(problems) > 0 {
+		return &InvalidLocatorError{Problems: problems}
 	}
 	return nil
 }
+
+func (loc Locator) hasFirestoreLocator() bool {
+	return len(loc.FirestoreLocator.CollectionPath) > 0 || len(loc.DocIDs) > 0 || len(loc.Filters) > 0
+}
+
+func (loc Locator) hasMongoLocator() bool {
+	return loc.MongoLocator.Collection != "" || len(loc.MongoLocator.Filter) > 0 || len(loc.MongoLocator.Where) > 0
+}
+
+// firestoreLocatorProblems returns the problems that keep Firestore from
+// reading loc.
+func firestoreLocatorProblems(loc Locator) []string {
+	var problems []string
+	path := loc.FirestoreLocator.CollectionPath
+	switch {
+	case len(path) == 0:
+		problems = append(problems, "FirestoreLocator needs a collection path")
+	case loc.LocatorType == Document && len(loc.DocIDs) != len(path):
+		problems = append(problems, fmt.Sprintf("document locator needs %d document IDs for collection path %v, got %d", len(path), path, len(loc.DocIDs)))
+	case loc.LocatorType == Collection && len(loc.DocIDs) != len(path)-1:
+		problems = append(problems, fmt.Sprintf("collection locator needs %d document IDs for collection path %v, got %d", len(path)-1, path, len(loc.DocIDs)))
+	}
+	for _, segment := range append(append([]string{}, path...), loc.DocIDs...) {
+		if segment == "" || strings.Contains(segment, "/") {
+			problems = append(problems, fmt.Sprintf("collection names and document IDs must be non-empty and not contain \"/\", got %q", segment))
+		}
+	}
+	if loc.LocatorType == Collection {
+		if err := checkFirestoreFilters(loc.Filters); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// mongoLocatorProblems returns the problems that keep MongoDB from reading
+// loc.
+func mongoLocatorProblems(loc Locator) []string {
+	var problems []string
+	if loc.MongoLocator.Collection == "" {
+		problems = append(problems, "MongoLocator needs a collection")
+	}
+	if loc.LocatorType == Document && len(loc.MongoLocator.Filter) == 0 && len(loc.MongoLocator.Where) == 0 {
+		problems = append(problems, "document locator needs a filter")
+	}
+	if _, err := loc.MongoLocator.query(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// reportPath returns the path of key in the value at path, such as
+// "Groupchats[0].Messages".
+func reportPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+// key returns a string identifying the data loc points to, such as
+// "gcs/abc/messages/123" for a Firestore document or
+// `users {"_id":{"$oid":"..."}}` for a Mongo document. Locators with equal keys
+// point to the same data.
+func (loc Locator) key() string {
+	parts := make([]string, 0, 2)
+	if len(loc.FirestoreLocator.CollectionPath) > 0 {
+		parts = append(parts, firestorePath(loc.FirestoreLocator.CollectionPath, loc.DocIDs))
+	}
+	if loc.MongoLocator.Collection != "" {
+		filter := "{}"
+		query, err := loc.MongoLocator.query()
+		if err != nil {
+			filter = fmt.Sprint(loc.MongoLocator.Filter, loc.MongoLocator.Where)
+		} else if len(query) > 0 {
+			if extJSON, err := bson.MarshalExtJSON(query, false, false); err == nil {
+				filter = string(extJSON)
+			} else {
+				filter = fmt.Sprint(query)
+			}
+		}
+		parts = append(parts, loc.MongoLocator.Collection+" "+filter)
+	}
+	return strings.Join(parts, " | ")
+}
+
+// firestorePath interleaves a Firestore collection path with document IDs,
+// e.g. [gcs, messages] and [abc] yield "gcs/abc/messages", and [gcs, messages]
+// and [abc, 123] yield "gcs/abc/messages/123".
+func firestorePath(collectionPath []string, docIDs []string) string {
+	segments := make([]string, 0, 2*len(collectionPath))
+	for i, collection := range collectionPath {
+		segments = append(segments, collection)
+		if i < len(docIDs) {
+			segments = append(segments, docIDs[i])
+		}
+	}
+	return strings.Join(segments, "/")
+}
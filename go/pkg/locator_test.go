@@ -0,0 +1,100 @@
+package pal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// validatingBackend is a countingBackend that validates locators like the
+// backend it wraps.
+type validatingBackend struct {
+	*countingBackend
+}
+
+func (b validatingBackend) ValidateLocator(loc Locator) []string {
+	return b.Backend.(LocatorValidator).ValidateLocator(loc)
+}
+
+func invalidFriendsLocators() []Locator {
+	users := FirestoreLocator{CollectionPath: []string{"users"}, DocIDs: []string{"u2"}}
+	return []Locator{
+		{LocatorType: Document, DataType: "user", FirestoreLocator: users},
+		{LocatorType: Document, DataType: "user", FirestoreLocator: FirestoreLocator{CollectionPath: []string{"users"}}},
+		{LocatorType: "doc", DataType: "user", FirestoreLocator: users, MongoLocator: MongoLocator{Collection: "users"}},
+		{LocatorType: Collection, DataType: "chat", FirestoreLocator: FirestoreLocator{CollectionPath: []string{"chats"}, Filters: []Filter{{Path: "users", Op: "~", Value: "u1"}}}},
+	}
+}
+
+func TestInvalidLocators(t *testing.T) {
+	wantProblems := []LocatorProblem{
+		{Locator: invalidFriendsLocators()[1], Problem: "document locator needs 1 document IDs for collection path [users], got 0"},
+		{Locator: invalidFriendsLocators()[2], Problem: `locator type must be "document" or "collection", got "doc"`},
+		{Locator: invalidFriendsLocators()[2], Problem: "only one of FirestoreLocator and MongoLocator may be set"},
+		{Locator: invalidFriendsLocators()[3], Problem: `filter operator "~" on users is not supported in Firestore`},
+	}
+	checkProblems := func(t *testing.T, err error, paths []string) {
+		var invalid *InvalidLocatorError
+		if !errors.As(err, &invalid) {
+			t.Fatalf("got error %v, want an *InvalidLocatorError", err)
+		}
+		if len(invalid.Problems) != len(wantProblems) {
+			t.Fatalf("got problems %+v, want %d", invalid.Problems, len(wantProblems))
+		}
+		for i, want := range wantProblems {
+			want.Path = paths[i]
+			if got := invalid.Problems[i]; !reflect.DeepEqual(got, want) {
+				t.Errorf("got problem %+v, want %+v", got, want)
+			}
+		}
+	}
+
+	t.Run("access", func(t *testing.T) {
+		backend := validatingBackend{&countingBackend{Backend: newFriendsBackend(t)}}
+		handleAccess := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+			locs := invalidFriendsLocators()
+			return map[string]interface{}{
+				"Friends": map[string]Locator{"u2": locs[0], "u3": locs[1]},
+				"Others":  locs[2:],
+			}, nil
+		}
+		_, err := NewClient(backend).ProcessAccessRequest(handleAccess, friendsSubject("u1"), "u1")
+		checkProblems(t, err, []string{"Friends.u3", "Others[0]", "Others[0]", "Others[1]"})
+		if backend.getOne != 1 {
+			t.Errorf("got %d reads, want only the data subject to be read", backend.getOne)
+		}
+	})
+
+	t.Run("deletion", func(t *testing.T) {
+		backend := newFriendsBackend(t)
+		handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+			return invalidFriendsLocators(), true, FieldUpdates{}, nil
+		}
+		_, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, friendsSubject("u1"), "u1", true)
+		checkProblems(t, err, []string{"nodesToTraverse[1]", "nodesToTraverse[2]", "nodesToTraverse[2]", "nodesToTraverse[3]"})
+		if _, ok := backend.Get("users/u1"); !ok {
+			t.Error("users/u1 was deleted")
+		}
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		subject := testLocator("user", Document, nil, nil, "users", nil)
+		_, err := NewClient(newTestMongoBackend(t)).ProcessAccessRequestWithContext(context.Background(), testHandleAccess(t, MongoStyle), subject, testUserID)
+		var invalid *InvalidLocatorError
+		if !errors.As(err, &invalid) {
+			t.Fatalf("got error %v, want an *InvalidLocatorError", err)
+		}
+		want := []LocatorProblem{{Locator: subject, Problem: "document locator needs a filter"}}
+		if !reflect.DeepEqual(invalid.Problems, want) {
+			t.Errorf("got problems %+v, want %+v", invalid.Problems, want)
+		}
+
+		where := testLocator("user", Document, nil, nil, "users", bson.D{{Key: "name", Value: "user1"}})
+		if problems := locatorProblems(newTestMongoBackend(t), where); len(problems) > 0 {
+			t.Errorf("got problems %v for a document locator with a filter", problems)
+		}
+	})
+}
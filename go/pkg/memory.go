@@ -0,0 +1,417 @@
+package pal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// MemoryStyle selects which half of a Locator a MemoryBackend resolves.
+type MemoryStyle int
+
+const (
+	// FirestoreStyle resolves locators through FirestoreLocator and applies
+	// FieldUpdates.Updates and FieldUpdates.FirestoreUpdates. Of the
+	// firestore package values, it only applies firestore.Delete and
+	// firestore.ServerTimestamp; use FieldUpdates.Updates instead of field
+	// transforms such as firestore.ArrayRemove.
+	FirestoreStyle MemoryStyle = iota
+	// MongoStyle resolves locators through MongoLocator and applies
+	// FieldUpdates.Updates and FieldUpdates.MongoUpdates.
+	MongoStyle
+)
+
+// MemoryBackend is a Backend that keeps all documents in memory. It is meant
+// for unit testing HandleAccess and HandleDeletion functions without a
+// database: seed it with Put, run requests through NewClient(backend), and
+// inspect the outcome with Get. It implements BatchBackend,
+// ConditionalBackend, with fingerprints that hash the content of documents,
+// ReferenceResolver, LocatorValidator and NamedBackend.
+//
+// A FirestoreStyle backend supports nested collections and the Filter
+// operators understood by Firestore. A MongoStyle backend supports top-level
+// collections, filters built from $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin,
+// $elemMatch, $exists, $and, $or and $nor, and updates built from $set, $unset, $inc,
+// $push, $addToSet and $pull. ObjectID values in filters are compared with
+// document IDs by their hex representation.
+type MemoryBackend struct {
+	style MemoryStyle
+
+	mu sync.RWMutex
+	// collections maps a collection path such as "users" or "gcs/abc/messages"
+	// to the documents in that collection, keyed by document ID.
+	collections map[string]map[string]DatabaseObject
+}
+
+func NewMemoryBackend(style MemoryStyle) *MemoryBackend {
+	return &MemoryBackend{
+		style:       style,
+		collections: make(map[string]map[string]DatabaseObject),
+	}
+}
+
+// Put stores a copy of doc under path, replacing any existing document. path
+// alternates collection names and document IDs, e.g. "users/123" or
+// "gcs/abc/messages/456". MongoStyle backends only accept top-level paths.
+func (m *MemoryBackend) Put(path string, doc map[string]interface{}) error {
+	collection, id, err := m.splitPath(path)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.collections[collection] == nil {
+		m.collections[collection] = make(map[string]DatabaseObject)
+	}
+	stored := copyValue(map[string]interface{}(doc)).(map[string]interface{})
+	delete(stored, "_id")
+	m.collections[collection][id] = stored
+	return nil
+}
+
+// Get returns a copy of the document stored under path, with its ID under the
+// "_id" key, and whether it exists.
+func (m *MemoryBackend) Get(path string) (DatabaseObject, bool) {
+	collection, id, err := m.splitPath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	doc, ok := m.collections[collection][id]
+	if !ok {
+		return nil, false
+	}
+	return withMemoryID(doc, id), true
+}
+
+func (m *MemoryBackend) GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	if err := ctx.Err(); err != nil {
+		return LocatorAndObject{}, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	collection, id, err := m.findDocument(m.collections, loc)
+	if err != nil {
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+	if id == "" {
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, ErrDocumentNotFound)
+	}
+
+	loc.LocatorType = Document
+	return m.result(loc, collection, id), nil
+}
+
+func (m *MemoryBackend) GetDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	collection, ids, err := m.findDocuments(m.collections, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+
+	if limit := FetchLimit(ctx); limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	results := make([]LocatorAndObject, 0, len(ids))
+	for _, id := range ids {
+		docLoc := Locator{
+			LocatorType: Document,
+			DataType:    loc.DataType,
+			Context:     loc.Context,
+		}
+		if m.style == MongoStyle {
+			docLoc.MongoLocator = MongoLocator{
+				Collection: loc.MongoLocator.Collection,
+				Filter:     bson.D{{Key: "_id", Value: mongoID(id)}},
+			}
+		} else {
+			docLoc.FirestoreLocator = FirestoreLocator{
+				CollectionPath: loc.FirestoreLocator.CollectionPath,
+				DocIDs:         append(append([]string{}, loc.DocIDs...), id),
+			}
+		}
+		results = append(results, m.result(docLoc, collection, id))
+	}
+	return results, nil
+}
+
+// ResolveReference resolves the reference of loc like the Firestore or MongoDB
+// backend, depending on the style of m.
+func (m *MemoryBackend) ResolveReference(loc Locator) (Locator, error) {
+	if m.style == MongoStyle {
+		return loc.resolveMongo()
+	}
+	return loc.resolveFirestore()
+}
+
+// Name returns "memory", whatever the style of m.
+func (m *MemoryBackend) Name() string {
+	return "memory"
+}
+
+// ValidateLocator checks loc like the Firestore or MongoDB backend, depending
+// on the style of m.
+func (m *MemoryBackend) ValidateLocator(loc Locator) []string {
+	if m.style == MongoStyle {
+		return mongoLocatorProblems(loc)
+	}
+	return firestoreLocatorProblems(loc)
+}
+
+func (m *MemoryBackend) GetAll(ctx context.Context, locs []Locator) ([]LocatorAndObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	results := make([]LocatorAndObject, len(locs))
+	for i, loc := range locs {
+		collection, id, err := m.findDocument(m.collections, loc)
+		if err != nil {
+			return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+		}
+		if id == "" {
+			return nil, fmt.Errorf("%s %s: %w", GET_DOCUMENT_ERROR, loc.key(), ErrDocumentNotFound)
+		}
+		loc.LocatorType = Document
+		results[i] = m.result(loc, collection, id)
+	}
+	return results, nil
+}
+
+// UpdateAndDelete applies all deletions, then all updates. Either every write
+// is applied or, if any of them fails, none is.
+func (m *MemoryBackend) UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	collections, err := m.applyWrites(ctx, documentsToUpdate, nodesToDelete)
+	if err != nil {
+		return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
+	}
+	m.collections = collections
+	return nil
+}
+
+// result returns the document id of collection, located by loc, along with
+// its fingerprint. The caller must hold the lock.
+func (m *MemoryBackend) result(loc Locator, collection string, id string) LocatorAndObject {
+	doc := withMemoryID(m.collections[collection][id], id)
+	// documents that cannot be hashed have no fingerprint, and Fingerprint
+	// reports why
+	fingerprint, _ := documentHash(doc)
+	return LocatorAndObject{Locator: loc, Object: doc, Fingerprint: fingerprint}
+}
+
+// Fingerprint returns a hash of the content of the document loc points to.
+func (m *MemoryBackend) Fingerprint(ctx context.Context, loc Locator) (string, error) {
+	locAndObj, err := m.GetDocument(ctx, loc)
+	if err != nil {
+		return "", err
+	}
+	return documentHash(locAndObj.Object)
+}
+
+func (m *MemoryBackend) UpdateAndDeleteIfUnchanged(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator, fingerprints map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var stale []Locator
+	for _, loc := range writeLocators(documentsToUpdate, nodesToDelete) {
+		collection, id, err := m.findDocument(m.collections, loc)
+		if err != nil {
+			return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
+		}
+		hash := ""
+		if id != "" {
+			if hash, err = documentHash(withMemoryID(m.collections[collection][id], id)); err != nil {
+				return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
+			}
+		}
+		if hash != fingerprints[loc.key()] {
+			stale = append(stale, loc)
+		}
+	}
+	if len(stale) > 0 {
+		return &StaleDocumentError{Locators: stale}
+	}
+
+	collections, err := m.applyWrites(ctx, documentsToUpdate, nodesToDelete)
+	if err != nil {
+		return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
+	}
+	m.collections = collections
+	return nil
+}
+
+// applyWrites applies the writes to a copy of the stored collections and
+// returns the copy. The caller must hold the write lock.
+func (m *MemoryBackend) applyWrites(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) (map[string]map[string]DatabaseObject, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	collections := make(map[string]map[string]DatabaseObject, len(m.collections))
+	for name, docs := range m.collections {
+		collections[name] = make(map[string]DatabaseObject, len(docs))
+		for id, doc := range docs {
+			collections[name][id] = doc
+		}
+	}
+
+	// delete nodes
+	for _, nodeLocator := range nodesToDelete {
+		collection, id, err := m.findDocument(collections, nodeLocator)
+		if err != nil {
+			return nil, err
+		}
+		if id != "" {
+			delete(collections[collection], id)
+		}
+	}
+
+	// update nodes
+	for _, update := range documentsToUpdate {
+		collection, id, err := m.findDocument(collections, update.Locator)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			if m.style == MongoStyle {
+				// like UpdateOne, an update that matches nothing is not an error
+				continue
+			}
+			docIDs := update.Locator.DocIDs
+			return nil, fmt.Errorf("cannot update %s/%s: %w", collection, docIDs[len(docIDs)-1], ErrDocumentNotFound)
+		}
+
+		// documents are shared with the previous state, so update a copy
+		doc := copyValue(map[string]interface{}(collections[collection][id])).(map[string]interface{})
+		if err := applyUpdates(doc, update.FieldsToUpdate, m.style); err != nil {
+			return nil, err
+		}
+		collections[collection][id] = doc
+	}
+
+	return collections, nil
+}
+
+// findDocument returns the collection path and ID of the document loc points
+// to. id is empty if no document matches.
+func (m *MemoryBackend) findDocument(collections map[string]map[string]DatabaseObject, loc Locator) (collection string, id string, err error) {
+	if m.style == MongoStyle {
+		collection, ids, err := m.findMongoDocuments(collections, loc)
+		if err != nil || len(ids) == 0 {
+			return collection, "", err
+		}
+		return collection, ids[0], nil
+	}
+
+	path := loc.FirestoreLocator.CollectionPath
+	if len(path) == 0 || len(loc.DocIDs) != len(path) {
+		return "", "", fmt.Errorf("document locator must have the same number of docIDs as collection path elements")
+	}
+	collection = firestorePath(path, loc.DocIDs[:len(path)-1])
+	id = loc.DocIDs[len(loc.DocIDs)-1]
+	if _, ok := collections[collection][id]; !ok {
+		return collection, "", nil
+	}
+	return collection, id, nil
+}
+
+// findDocuments returns the collection path and the sorted IDs of the
+// documents loc points to.
+func (m *MemoryBackend) findDocuments(collections map[string]map[string]DatabaseObject, loc Locator) (collection string, ids []string, err error) {
+	if m.style == MongoStyle {
+		return m.findMongoDocuments(collections, loc)
+	}
+
+	path := loc.FirestoreLocator.CollectionPath
+	if len(path) == 0 || len(loc.DocIDs) != len(path)-1 {
+		return "", nil, fmt.Errorf("collection locator must have one less docID than collection path elements")
+	}
+	collection = firestorePath(path, loc.DocIDs)
+	for _, id := range sortedMemoryIDs(collections[collection]) {
+		matches := true
+		for _, filter := range loc.Filters {
+			matches, err = matchFirestoreFilter(withMemoryID(collections[collection][id], id), filter)
+			if err != nil {
+				return "", nil, err
+			}
+			if !matches {
+				break
+			}
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	return collection, ids, nil
+}
+
+func (m *MemoryBackend) findMongoDocuments(collections map[string]map[string]DatabaseObject, loc Locator) (collection string, ids []string, err error) {
+	collection = loc.MongoLocator.Collection
+	if collection == "" {
+		return "", nil, fmt.Errorf("mongo locator must have a collection")
+	}
+	query, err := loc.MongoLocator.query()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, id := range sortedMemoryIDs(collections[collection]) {
+		matches, err := matchMongoFilter(withMemoryID(collections[collection][id], id), query)
+		if err != nil {
+			return "", nil, err
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	return collection, ids, nil
+}
+
+func (m *MemoryBackend) splitPath(path string) (collection string, id string, err error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments)%2 != 0 {
+		return "", "", fmt.Errorf("document path %q must alternate collections and document IDs", path)
+	}
+	if m.style == MongoStyle && len(segments) != 2 {
+		return "", "", fmt.Errorf("document path %q must be a top-level collection and a document ID", path)
+	}
+	return strings.Join(segments[:len(segments)-1], "/"), segments[len(segments)-1], nil
+}
+
+func sortedMemoryIDs(docs map[string]DatabaseObject) []string {
+	ids := make([]string, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func withMemoryID(doc DatabaseObject, id string) DatabaseObject {
+	result := copyValue(map[string]interface{}(doc)).(map[string]interface{})
+	result["_id"] = id
+	return result
+}
@@ -0,0 +1,705 @@
+package pal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// This file holds the query and update semantics of MemoryBackend: matching
+// Firestore filters and Mongo filter documents against plain documents, and
+// applying Firestore and Mongo updates to them.
+
+func matchFirestoreFilter(doc map[string]interface{}, filter Filter) (bool, error) {
+	value, exists := lookupField(doc, strings.Split(filter.Path, "."))
+
+	switch filter.Op {
+	case "==":
+		return exists && valuesEqual(value, filter.Value), nil
+	case "!=":
+		return exists && !valuesEqual(value, filter.Value), nil
+	case "<", "<=", ">", ">=":
+		if !exists {
+			return false, nil
+		}
+		cmp, ok := compareValues(value, filter.Value)
+		return ok && compareSatisfies(filter.Op, cmp), nil
+	case "in", "not-in":
+		candidates, ok := toSlice(filter.Value)
+		if !ok {
+			return false, fmt.Errorf("filter %q on %s needs a slice value", filter.Op, filter.Path)
+		}
+		if !exists {
+			return false, nil
+		}
+		return containsValue(candidates, value) == (filter.Op == "in"), nil
+	case "array-contains":
+		elems, ok := toSlice(value)
+		return exists && ok && containsValue(elems, filter.Value), nil
+	case "array-contains-any":
+		candidates, ok := toSlice(filter.Value)
+		if !ok {
+			return false, fmt.Errorf("filter %q on %s needs a slice value", filter.Op, filter.Path)
+		}
+		elems, ok := toSlice(value)
+		if !exists || !ok {
+			return false, nil
+		}
+		for _, candidate := range candidates {
+			if containsValue(elems, candidate) {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("unsupported filter operator %q", filter.Op)
+	}
+}
+
+// matchMongoFilter reports whether doc matches a Mongo filter document such as
+// bson.D{{Key: "userId", Value: "123"}} or bson.M{"age": bson.M{"$gt": 18}}.
+// A nil filter matches every document.
+func matchMongoFilter(doc map[string]interface{}, filter interface{}) (bool, error) {
+	entries, err := toBsonD(filter)
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range entries {
+		var matches bool
+		switch entry.Key {
+		case "$and", "$or", "$nor":
+			clauses, ok := entry.Value.(bson.A)
+			if !ok {
+				return false, fmt.Errorf("%s needs an array of filters", entry.Key)
+			}
+			matched := 0
+			for _, clause := range clauses {
+				ok, err := matchMongoFilter(doc, clause)
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					matched++
+				}
+			}
+			switch entry.Key {
+			case "$and":
+				matches = matched == len(clauses)
+			case "$or":
+				matches = matched > 0
+			case "$nor":
+				matches = matched == 0
+			}
+		default:
+			value, exists := lookupField(doc, strings.Split(entry.Key, "."))
+			if operators, ok := mongoOperators(entry.Value); ok {
+				matches, err = matchMongoOperators(value, exists, operators)
+				if err != nil {
+					return false, err
+				}
+			} else {
+				matches = mongoEquals(value, exists, entry.Value)
+			}
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func matchMongoOperators(value interface{}, exists bool, operators bson.D) (bool, error) {
+	for _, operator := range operators {
+		var matches bool
+		switch operator.Key {
+		case "$eq":
+			matches = mongoEquals(value, exists, operator.Value)
+		case "$ne":
+			matches = !mongoEquals(value, exists, operator.Value)
+		case "$gt", "$gte", "$lt", "$lte":
+			op := map[string]string{"$gt": ">", "$gte": ">=", "$lt": "<", "$lte": "<="}[operator.Key]
+			candidates := []interface{}{value}
+			if elems, ok := toSlice(value); ok {
+				candidates = elems
+			}
+			for _, candidate := range candidates {
+				if cmp, ok := compareValues(candidate, operator.Value); exists && ok && compareSatisfies(op, cmp) {
+					matches = true
+					break
+				}
+			}
+		case "$in", "$nin":
+			candidates, ok := toSlice(operator.Value)
+			if !ok {
+				return false, fmt.Errorf("%s needs an array", operator.Key)
+			}
+			for _, candidate := range candidates {
+				if mongoEquals(value, exists, candidate) {
+					matches = true
+					break
+				}
+			}
+			if operator.Key == "$nin" {
+				matches = !matches
+			}
+		case "$elemMatch":
+			elems, ok := toSlice(value)
+			if !exists || !ok {
+				break
+			}
+			for _, elem := range elems {
+				var err error
+				if elemOperators, ok := mongoOperators(operator.Value); ok {
+					matches, err = matchMongoOperators(elem, true, elemOperators)
+				} else if fields, ok := toMap(elem); ok {
+					matches, err = matchMongoFilter(fields, operator.Value)
+				}
+				if err != nil {
+					return false, err
+				}
+				if matches {
+					break
+				}
+			}
+		case "$exists":
+			want, ok := operator.Value.(bool)
+			if !ok {
+				return false, fmt.Errorf("$exists needs a boolean")
+			}
+			matches = exists == want
+		default:
+			return false, fmt.Errorf("unsupported filter operator %q", operator.Key)
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// mongoEquals implements Mongo's equality match: a missing field equals null,
+// and an array field matches if the array itself or any of its elements is
+// equal to the wanted value.
+func mongoEquals(value interface{}, exists bool, want interface{}) bool {
+	if !exists {
+		return want == nil
+	}
+	if valuesEqual(value, want) {
+		return true
+	}
+	if elems, ok := toSlice(value); ok {
+		return containsValue(elems, want)
+	}
+	return false
+}
+
+// mongoOperators returns value as a list of operators if it is a document
+// whose keys all start with "$", such as bson.D{{Key: "$gt", Value: 1}}.
+func mongoOperators(value interface{}) (bson.D, bool) {
+	doc, ok := value.(bson.D)
+	if !ok || len(doc) == 0 {
+		return nil, false
+	}
+	for _, entry := range doc {
+		if !strings.HasPrefix(entry.Key, "$") {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// applyUpdates applies updates to doc the way the Firestore or MongoDB backend
+// does, depending on style: Updates, then FirestoreUpdates or MongoUpdates.
+func applyUpdates(doc map[string]interface{}, updates FieldUpdates, style MemoryStyle) error {
+	if style == MongoStyle {
+		mongoUpdates, err := updates.mongoUpdates()
+		if err != nil {
+			return err
+		}
+		for _, mongoUpdate := range mongoUpdates {
+			if err := applyMongoUpdate(doc, mongoUpdate); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, update := range updates.Updates {
+		if err := applyFieldUpdate(doc, update); err != nil {
+			return err
+		}
+	}
+	for _, update := range updates.FirestoreUpdates {
+		if err := applyFirestoreUpdate(doc, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFieldUpdate applies a backend-neutral update with Firestore semantics.
+func applyFieldUpdate(doc map[string]interface{}, update FieldUpdate) error {
+	path := update.fieldPath()
+	switch update.Op {
+	case SetOp:
+		setField(doc, path, copyValue(update.Value))
+	case UnsetOp, RemoveMapKeyOp:
+		deleteField(doc, path)
+	case ArrayUnionOp:
+		current, _ := lookupField(doc, path)
+		elems, _ := toSlice(current)
+		for _, elem := range update.Values {
+			if !containsValue(elems, elem) {
+				elems = append(elems, copyValue(elem))
+			}
+		}
+		setField(doc, path, elems)
+	case ArrayRemoveOp:
+		current, _ := lookupField(doc, path)
+		elems, _ := toSlice(current)
+		setField(doc, path, removeValues(elems, update.Values))
+	case IncrementOp:
+		// Firestore stores every integer as an int64 and every other number
+		// as a float64
+		operand := update.Value
+		if n, ok := toInt64(operand); ok {
+			operand = n
+		} else if f, ok := toFloat64(operand); ok {
+			operand = f
+		}
+		return incrementField(doc, path, operand)
+	default:
+		return fmt.Errorf("unsupported update operation %q on %s", update.Op, update.Path)
+	}
+	return nil
+}
+
+func applyFirestoreUpdate(doc map[string]interface{}, update firestore.Update) error {
+	path := update.FieldPath
+	if len(path) == 0 {
+		path = strings.Split(update.Path, ".")
+	}
+	if len(path) == 0 || path[0] == "" {
+		return fmt.Errorf("firestore update needs a Path or FieldPath")
+	}
+
+	value := update.Value
+	switch {
+	case value == firestore.Delete:
+		deleteField(doc, path)
+	case value == firestore.ServerTimestamp:
+		setField(doc, path, time.Now().UTC())
+	case isFirestoreTransform(value):
+		// the firestore package does not expose what its transforms hold
+		return fmt.Errorf("the field transform on %s is not supported, use FieldUpdates.Updates", strings.Join(path, "."))
+	default:
+		setField(doc, path, copyValue(value))
+	}
+	return nil
+}
+
+// applyMongoUpdate applies a single update document, such as
+// bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "anonymous"}}}}.
+func applyMongoUpdate(doc map[string]interface{}, update interface{}) error {
+	if _, ok := update.(bson.D); !ok {
+		if _, ok := toSlice(update); ok {
+			return fmt.Errorf("update pipelines are not supported")
+		}
+	}
+	operators, err := toBsonD(update)
+	if err != nil {
+		return err
+	}
+
+	for _, operator := range operators {
+		fields, ok := operator.Value.(bson.D)
+		if !ok {
+			return fmt.Errorf("update operator %q needs a document, got %T (update documents must only contain operators)", operator.Key, operator.Value)
+		}
+		for _, field := range fields {
+			path := strings.Split(field.Key, ".")
+			switch operator.Key {
+			case "$set":
+				setField(doc, path, plainValue(field.Value))
+			case "$unset":
+				deleteField(doc, path)
+			case "$inc":
+				if err := incrementField(doc, path, plainValue(field.Value)); err != nil {
+					return err
+				}
+			case "$push", "$addToSet":
+				current, _ := lookupField(doc, path)
+				elems, _ := toSlice(current)
+				values := []interface{}{plainValue(field.Value)}
+				if each, ok := field.Value.(bson.D); ok && len(each) == 1 && each[0].Key == "$each" {
+					values, _ = toSlice(plainValue(each[0].Value))
+				}
+				for _, value := range values {
+					if operator.Key == "$push" || !containsValue(elems, value) {
+						elems = append(elems, value)
+					}
+				}
+				setField(doc, path, elems)
+			case "$pull":
+				current, exists := lookupField(doc, path)
+				elems, ok := toSlice(current)
+				if !exists || !ok {
+					continue
+				}
+				kept := make([]interface{}, 0, len(elems))
+				for _, elem := range elems {
+					matches, err := matchMongoPullCondition(elem, field.Value)
+					if err != nil {
+						return err
+					}
+					if !matches {
+						kept = append(kept, elem)
+					}
+				}
+				setField(doc, path, kept)
+			default:
+				return fmt.Errorf("unsupported update operator %q", operator.Key)
+			}
+		}
+	}
+	return nil
+}
+
+// matchMongoPullCondition reports whether an array element is removed by a
+// $pull condition, which is either a value, a set of operators applied to the
+// element, or a filter applied to an element that is itself a document.
+func matchMongoPullCondition(elem interface{}, condition interface{}) (bool, error) {
+	if operators, ok := mongoOperators(condition); ok {
+		return matchMongoOperators(elem, true, operators)
+	}
+	if _, ok := condition.(bson.D); ok {
+		elemDoc, ok := elem.(map[string]interface{})
+		if !ok {
+			return false, nil
+		}
+		return matchMongoFilter(elemDoc, condition)
+	}
+	return valuesEqual(elem, condition), nil
+}
+
+func lookupField(doc map[string]interface{}, path []string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, key := range path {
+		fields, ok := toMap(current)
+		if !ok {
+			return nil, false
+		}
+		current, ok = fields[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func setField(doc map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[path[len(path)-1]] = value
+}
+
+func deleteField(doc map[string]interface{}, path []string) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, path[len(path)-1])
+}
+
+func incrementField(doc map[string]interface{}, path []string, operand interface{}) error {
+	current, exists := lookupField(doc, path)
+	if !exists {
+		setField(doc, path, operand)
+		return nil
+	}
+	currentInt, currentIsInt := toInt64(current)
+	operandInt, operandIsInt := toInt64(operand)
+	if currentIsInt && operandIsInt {
+		setField(doc, path, currentInt+operandInt)
+		return nil
+	}
+	currentFloat, ok := toFloat64(current)
+	if !ok {
+		return fmt.Errorf("cannot increment non-numeric field %s", strings.Join(path, "."))
+	}
+	operandFloat, ok := toFloat64(operand)
+	if !ok {
+		return fmt.Errorf("cannot increment %s by non-numeric value %v", strings.Join(path, "."), operand)
+	}
+	setField(doc, path, currentFloat+operandFloat)
+	return nil
+}
+
+func removeValues(elems []interface{}, remove []interface{}) []interface{} {
+	kept := make([]interface{}, 0, len(elems))
+	for _, elem := range elems {
+		if !containsValue(remove, elem) {
+			kept = append(kept, elem)
+		}
+	}
+	return kept
+}
+
+func containsValue(elems []interface{}, value interface{}) bool {
+	for _, elem := range elems {
+		if valuesEqual(elem, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesEqual compares two values after normalizing the representations that
+// differ between backends and callers: all numbers compare as float64,
+// ObjectIDs as their hex string and times in UTC.
+func valuesEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeValue(a), normalizeValue(b))
+}
+
+// compareValues orders two numbers, strings, booleans or times. ok is false if
+// the values are not comparable with each other.
+func compareValues(a, b interface{}) (cmp int, ok bool) {
+	a, b = normalizeValue(a), normalizeValue(b)
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		return compareOrdered(a < b, a > b), true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	case bool:
+		b, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		return compareOrdered(!a && b, a && !b), true
+	case time.Time:
+		b, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		return compareOrdered(a.Before(b), a.After(b)), true
+	}
+	return 0, false
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func compareSatisfies(op string, cmp int) bool {
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case time.Time:
+		return v.UTC()
+	case bson.D:
+		fields := make(map[string]interface{}, len(v))
+		for _, entry := range v {
+			fields[entry.Key] = normalizeValue(entry.Value)
+		}
+		return fields
+	}
+	if f, ok := toFloat64(value); ok {
+		return f
+	}
+	if fields, ok := toMap(value); ok {
+		normalized := make(map[string]interface{}, len(fields))
+		for key, field := range fields {
+			normalized[key] = normalizeValue(field)
+		}
+		return normalized
+	}
+	if elems, ok := toSlice(value); ok {
+		normalized := make([]interface{}, len(elems))
+		for i, elem := range elems {
+			normalized[i] = normalizeValue(elem)
+		}
+		return normalized
+	}
+	return value
+}
+
+// plainValue converts the bson types produced by toBsonD back into the plain
+// Go values MemoryBackend stores.
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		fields := make(map[string]interface{}, len(v))
+		for _, entry := range v {
+			fields[entry.Key] = plainValue(entry.Value)
+		}
+		return fields
+	case bson.A:
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			elems[i] = plainValue(elem)
+		}
+		return elems
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case primitive.ObjectID:
+		return v.Hex()
+	}
+	return value
+}
+
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, field := range v {
+			fields[key] = copyValue(field)
+		}
+		return fields
+	case DatabaseObject:
+		return copyValue(map[string]interface{}(v))
+	case []interface{}:
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			elems[i] = copyValue(elem)
+		}
+		return elems
+	}
+	return value
+}
+
+// toBsonD converts a Mongo filter or update document of any supported Go type
+// (bson.D, bson.M, maps and structs) into a bson.D, converting nested documents
+// and arrays into bson.D and bson.A along the way.
+func toBsonD(value interface{}) (bson.D, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if doc, ok := value.(bson.D); ok && len(doc) == 0 {
+		return nil, nil
+	}
+	raw, err := bson.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mongo document: %w", err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid mongo document: %w", err)
+	}
+	return doc, nil
+}
+
+func toMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case DatabaseObject:
+		return v, true
+	case bson.M:
+		return v, true
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	fields := make(map[string]interface{}, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		fields[iter.Key().String()] = iter.Value().Interface()
+	}
+	return fields, true
+}
+
+func toSlice(value interface{}) ([]interface{}, bool) {
+	switch v := value.(type) {
+	case []interface{}:
+		return v, true
+	case bson.A:
+		return v, true
+	case nil:
+		return nil, false
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	// byte slices are binary values rather than arrays
+	if rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	elems := make([]interface{}, rv.Len())
+	for i := range elems {
+		elems[i] = rv.Index(i).Interface()
+	}
+	return elems, true
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(rv.Uint()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,298 @@
+package pal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	testUserID  = "64b7f0c2a1b2c3d4e5f60001"
+	testOtherID = "64b7f0c2a1b2c3d4e5f60002"
+	testChatID  = "64b7f0c2a1b2c3d4e5f60003"
+)
+
+// newTestFirestoreBackend seeds a small chat application: two users sharing a
+// group chat that holds messages from both of them.
+func newTestFirestoreBackend(t *testing.T) *MemoryBackend {
+	backend := NewMemoryBackend(FirestoreStyle)
+	docs := map[string]map[string]interface{}{
+		"users/" + testUserID:                {"name": "user1", "gcs": []interface{}{testChatID}},
+		"users/" + testOtherID:               {"name": "user2", "gcs": []interface{}{testChatID}},
+		"gcs/" + testChatID:                  {"owner": testOtherID, "users": []interface{}{testUserID, testOtherID}},
+		"gcs/" + testChatID + "/messages/m1": {"userId": testUserID, "content": "hello"},
+		"gcs/" + testChatID + "/messages/m2": {"userId": testOtherID, "content": "hi"},
+		"gcs/" + testChatID + "/messages/m3": {"userId": testUserID, "content": "how are you?"},
+	}
+	for path, doc := range docs {
+		if err := backend.Put(path, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return backend
+}
+
+func newTestMongoBackend(t *testing.T) *MemoryBackend {
+	backend := NewMemoryBackend(MongoStyle)
+	docs := map[string]map[string]interface{}{
+		"users/" + testUserID:  {"name": "user1", "gcs": []interface{}{testChatID}},
+		"users/" + testOtherID: {"name": "user2", "gcs": []interface{}{testChatID}},
+		"gcs/" + testChatID:    {"owner": testOtherID, "users": []interface{}{testUserID, testOtherID}},
+		"messages/m1":          {"chatId": testChatID, "userId": testUserID, "content": "hello"},
+		"messages/m2":          {"chatId": testChatID, "userId": testOtherID, "content": "hi"},
+		"messages/m3":          {"chatId": testChatID, "userId": testUserID, "content": "how are you?"},
+	}
+	for path, doc := range docs {
+		if err := backend.Put(path, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return backend
+}
+
+func testLocator(dataType string, locatorType LocatorType, collectionPath []string, docIDs []string, collection string, filter bson.D) Locator {
+	return Locator{
+		LocatorType: locatorType,
+		DataType:    dataType,
+		FirestoreLocator: FirestoreLocator{
+			CollectionPath: collectionPath,
+			DocIDs:         docIDs,
+		},
+		MongoLocator: MongoLocator{
+			Collection: collection,
+			Filter:     filter,
+		},
+	}
+}
+
+func objectID(t *testing.T, hex string) primitive.ObjectID {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func testHandleAccess(t *testing.T, style MemoryStyle) HandleAccessFunc {
+	return func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+		switch currentDbObjLocator.DataType {
+		case "user":
+			chats := make([]Locator, 0)
+			for _, id := range dbObj["gcs"].([]interface{}) {
+				id := id.(string)
+				if style == MongoStyle {
+					chats = append(chats, testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, id)}}))
+				} else {
+					chats = append(chats, testLocator("groupchat", Document, []string{"gcs"}, []string{id}, "", nil))
+				}
+			}
+			return map[string]interface{}{"Name": dbObj["name"], "Groupchats": chats}, nil
+		case "groupchat":
+			if style == MongoStyle {
+				messages := testLocator("message", Collection, nil, nil, "messages", bson.D{{Key: "userId", Value: dataSubjectId}, {Key: "chatId", Value: dbObj["_id"]}})
+				return map[string]interface{}{"Messages": messages}, nil
+			}
+			messages := testLocator("message", Collection,
+				append(append([]string{}, currentDbObjLocator.FirestoreLocator.CollectionPath...), "messages"), currentDbObjLocator.DocIDs, "", nil)
+			messages.Filters = []Filter{{Path: "userId", Op: "==", Value: dataSubjectId}}
+			return map[string]interface{}{"Messages": messages}, nil
+		case "message":
+			return map[string]interface{}{"Content": dbObj["content"]}, nil
+		}
+		return nil, fmt.Errorf("invalid data type %s", currentDbObjLocator.DataType)
+	}
+}
+
+func TestMemoryBackendAccess(t *testing.T) {
+	want := map[string]interface{}{
+		"Name": "user1",
+		"Groupchats": []interface{}{
+			map[string]interface{}{
+				"Messages": []interface{}{
+					map[string]interface{}{"Content": "hello", DataTypeKey: "message"},
+					map[string]interface{}{"Content": "how are you?", DataTypeKey: "message"},
+				},
+				DataTypeKey: "groupchat",
+			},
+		},
+		DataTypeKey: "user",
+	}
+
+	tests := []struct {
+		name    string
+		backend *MemoryBackend
+	}{
+		{"firestore", newTestFirestoreBackend(t)},
+		{"mongo", newTestMongoBackend(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject := testLocator("user", Document, []string{"users"}, []string{testUserID}, "", nil)
+			if tt.backend.style == MongoStyle {
+				subject = testLocator("user", Document, nil, nil, "users", bson.D{{Key: "_id", Value: objectID(t, testUserID)}})
+			}
+			report, err := NewClient(tt.backend).ProcessAccessRequest(testHandleAccess(t, tt.backend.style), subject, testUserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report, want) {
+				t.Errorf("got report %v, want %v", report, want)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendDeletionFirestore(t *testing.T) {
+	backend := newTestFirestoreBackend(t)
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		switch currentDbObjLocator.DataType {
+		case "user":
+			return []Locator{testLocator("groupchat", Document, []string{"gcs"}, []string{testChatID}, "", nil)}, true, FieldUpdates{}, nil
+		case "groupchat":
+			messages := testLocator("message", Collection, []string{"gcs", "messages"}, currentDbObjLocator.DocIDs, "", nil)
+			messages.Filters = []Filter{{Path: "userId", Op: "==", Value: dataSubjectId}}
+			updates := FieldUpdates{Updates: []FieldUpdate{ArrayRemove("users", dataSubjectId), Increment("edits", 1)}}
+			return []Locator{messages}, false, updates, nil
+		default:
+			return nil, true, FieldUpdates{}, nil
+		}
+	}
+
+	subject := testLocator("user", Document, []string{"users"}, []string{testUserID}, "", nil)
+	_, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, subject, testUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"users/" + testUserID, "gcs/" + testChatID + "/messages/m1", "gcs/" + testChatID + "/messages/m3"} {
+		if _, ok := backend.Get(path); ok {
+			t.Errorf("%s was not deleted", path)
+		}
+	}
+	if _, ok := backend.Get("gcs/" + testChatID + "/messages/m2"); !ok {
+		t.Errorf("message of another user was deleted")
+	}
+	chat, _ := backend.Get("gcs/" + testChatID)
+	if want := []interface{}{testOtherID}; !reflect.DeepEqual(chat["users"], want) {
+		t.Errorf("got users %v, want %v", chat["users"], want)
+	}
+	if chat["edits"] != int64(1) {
+		t.Errorf("got edits %v, want 1", chat["edits"])
+	}
+}
+
+func TestMemoryBackendDeletionMongo(t *testing.T) {
+	backend := newTestMongoBackend(t)
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		switch currentDbObjLocator.DataType {
+		case "user":
+			chat := testLocator("groupchat", Document, nil, nil, "gcs", bson.D{{Key: "_id", Value: objectID(t, testChatID)}})
+			return []Locator{chat}, true, FieldUpdates{}, nil
+		case "groupchat":
+			messages := testLocator("message", Collection, nil, nil, "messages", bson.D{
+				{Key: "userId", Value: dataSubjectId},
+				{Key: "chatId", Value: bson.D{{Key: "$in", Value: bson.A{dbObj["_id"]}}}},
+			})
+			updates := FieldUpdates{MongoUpdates: []interface{}{
+				bson.D{{Key: "$pull", Value: bson.D{{Key: "users", Value: dataSubjectId}}}},
+				bson.M{"$set": bson.M{"owner": "nobody"}},
+			}}
+			return []Locator{messages}, false, updates, nil
+		default:
+			return nil, true, FieldUpdates{}, nil
+		}
+	}
+
+	subject := testLocator("user", Document, nil, nil, "users", bson.D{{Key: "_id", Value: objectID(t, testUserID)}})
+	_, err := NewClient(backend).ProcessDeletionRequest(handleDeletion, subject, testUserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"users/" + testUserID, "messages/m1", "messages/m3"} {
+		if _, ok := backend.Get(path); ok {
+			t.Errorf("%s was not deleted", path)
+		}
+	}
+	if _, ok := backend.Get("messages/m2"); !ok {
+		t.Errorf("message of another user was deleted")
+	}
+	chat, _ := backend.Get("gcs/" + testChatID)
+	if want := []interface{}{testOtherID}; !reflect.DeepEqual(chat["users"], want) {
+		t.Errorf("got users %v, want %v", chat["users"], want)
+	}
+	if chat["owner"] != "nobody" {
+		t.Errorf("got owner %v, want nobody", chat["owner"])
+	}
+}
+
+func TestMatchMongoFilter(t *testing.T) {
+	doc := map[string]interface{}{
+		"_id":     "a",
+		"age":     int64(30),
+		"tags":    []interface{}{"x", "y"},
+		"profile": map[string]interface{}{"city": "Providence"},
+	}
+	tests := []struct {
+		filter interface{}
+		want   bool
+	}{
+		{nil, true},
+		{bson.D{{Key: "age", Value: 30}}, true},
+		{bson.M{"age": bson.M{"$gt": 18, "$lte": 30}}, true},
+		{bson.D{{Key: "age", Value: bson.D{{Key: "$lt", Value: 30}}}}, false},
+		{bson.D{{Key: "tags", Value: "y"}}, true},
+		{bson.D{{Key: "tags", Value: bson.D{{Key: "$nin", Value: bson.A{"x"}}}}}, false},
+		{bson.D{{Key: "profile.city", Value: "Providence"}}, true},
+		{bson.D{{Key: "missing", Value: bson.D{{Key: "$exists", Value: false}}}}, true},
+		{bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "age", Value: 1}}, bson.D{{Key: "_id", Value: "a"}}}}}, true},
+		{bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "_id", Value: "a"}}}}}, false},
+	}
+	for _, tt := range tests {
+		got, err := matchMongoFilter(doc, tt.filter)
+		if err != nil {
+			t.Errorf("matchMongoFilter(%v): %v", tt.filter, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("matchMongoFilter(%v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	if _, err := matchMongoFilter(doc, bson.D{{Key: "age", Value: bson.D{{Key: "$where", Value: "1"}}}}); err == nil {
+		t.Errorf("expected an error for an unsupported operator")
+	}
+}
+
+func TestFirestoreTransforms(t *testing.T) {
+	doc := map[string]interface{}{"name": "user1", "city": "Providence", "users": []interface{}{"u1"}}
+	for _, update := range []firestore.Update{
+		{Path: "name", Value: "anonymous"},
+		{Path: "city", Value: firestore.Delete},
+		{FieldPath: []string{"deletedAt"}, Value: firestore.ServerTimestamp},
+	} {
+		if err := applyFirestoreUpdate(doc, update); err != nil {
+			t.Errorf("applyFirestoreUpdate(%v): %v", update, err)
+		}
+	}
+	if _, ok := doc["deletedAt"].(time.Time); !ok || doc["name"] != "anonymous" || doc["city"] != nil {
+		t.Errorf("got document %v", doc)
+	}
+
+	// transforms are opaque, so only Firestore can apply them
+	for _, transform := range []interface{}{firestore.ArrayUnion("a"), firestore.ArrayRemove("u1"), firestore.Increment(1), firestore.FieldTransformMaximum(1)} {
+		err := applyFirestoreUpdate(doc, firestore.Update{Path: "users", Value: transform})
+		if err == nil || !strings.Contains(err.Error(), "use FieldUpdates.Updates") {
+			t.Errorf("got error %v applying %T, want one pointing to FieldUpdates.Updates", err, transform)
+		}
+	}
+	if !reflect.DeepEqual(doc["users"], []interface{}{"u1"}) {
+		t.Errorf("a transform changed the document: %v", doc["users"])
+	}
+}
@@ -2,124 +2,422 @@ package pal
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type mongoClient struct {
 	db *mongo.Database
 }
 
-func newDbClientForMongo(mongoDb *mongo.Database) databaseClient {
+func newDbClientForMongo(mongoDb *mongo.Database) Backend {
 	return &mongoClient{db: mongoDb}
 }
 
-func (c *mongoClient) getDocument(loc Locator) (locatorAndObject, error) {
+// MongoReadTimeout bounds every read of the MongoDB backend whose context has
+// no deadline, such as the reads of ProcessAccessRequest and
+// ProcessDeletionRequest.
+const MongoReadTimeout = 5 * time.Second
+
+// readContext returns ctx, bounded by MongoReadTimeout if it has no deadline.
+func readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, MongoReadTimeout)
+}
+
+func (c *mongoClient) GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
 	// Get a single result based on the collection and filter supplied in the locator
 	collection := c.db.Collection(loc.MongoLocator.Collection)
+	query, err := loc.MongoLocator.query()
+	if err != nil {
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := readContext(ctx)
 	defer cancel()
 
-	bsonResult := bson.M{}
-	if err := collection.FindOne(ctx, loc.MongoLocator.Filter).Decode(&bsonResult); err != nil {
+	raw, err := collection.FindOne(ctx, query).DecodeBytes()
+	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return locatorAndObject{}, fmt.Errorf("%s document does not exist", GET_DOCUMENT_ERROR)
+			return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, ErrDocumentNotFound)
 		}
-		return locatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
 	}
-
-	// Convert bson.M to DatabaseObject
-	tempBytes, err := bson.MarshalExtJSON(bsonResult, true, true)
-	if err != nil {
-		return locatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	bsonResult := bson.M{}
+	if err := bson.Unmarshal(raw, &bsonResult); err != nil {
+		return LocatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
 	}
 
-	result := DatabaseObject{}
-	err = json.Unmarshal(tempBytes, &result)
-	if err != nil {
-		return locatorAndObject{}, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
-	}
-	result["_id"] = bsonResult["_id"].(primitive.ObjectID).Hex()
+	result := mongoObject(bsonResult)
 
 	loc.LocatorType = Document
-	return locatorAndObject{Locator: loc, Object: result}, nil
+	return LocatorAndObject{Locator: loc, Object: result, Fingerprint: mongoHash(raw)}, nil
 }
 
-func (c *mongoClient) getDocuments(loc Locator) ([]locatorAndObject, error) {
+func (c *mongoClient) GetDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
 	// Get a list of results based on the collection and filter supplied in the locator
 	collection := c.db.Collection(loc.MongoLocator.Collection)
+	query, err := loc.MongoLocator.query()
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// sort by _id so results come back in a stable order, as Firestore does
+	findOptions := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if limit := FetchLimit(ctx); limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+	ctx, cancel := readContext(ctx)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, loc.MongoLocator.Filter)
+	cursor, err := collection.Find(ctx, query, findOptions)
 	if err != nil {
 		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
 	}
 
-	bsonResults := []bson.M{}
-	if err = cursor.All(ctx, &bsonResults); err != nil {
-		return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	bsonResults, fingerprints, err := readCursor(ctx, cursor)
+	if err != nil {
+		return nil, err
 	}
 
-	loc.LocatorType = Document
-	// Convert bson.M to DatabaseObject
-	results := []locatorAndObject{}
-	for _, result := range bsonResults {
-		tempBytes, err := bson.MarshalExtJSON(result, true, true)
-		if err != nil {
-			return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	results := []LocatorAndObject{}
+	for i, result := range bsonResults {
+		convertedResult := mongoObject(result)
+		// locate each result by its own _id rather than the collection filter
+		docLoc := Locator{
+			LocatorType: Document,
+			DataType:    loc.DataType,
+			Context:     loc.Context,
+			MongoLocator: MongoLocator{
+				Collection: loc.MongoLocator.Collection,
+				Filter:     bson.D{{Key: "_id", Value: result["_id"]}},
+			},
 		}
-		convertedResult := DatabaseObject{}
-		err = json.Unmarshal(tempBytes, &convertedResult)
+		results = append(results, LocatorAndObject{Locator: docLoc, Object: convertedResult, Fingerprint: fingerprints[i]})
+	}
+
+	return results, nil
+}
+
+// ResolveReference turns the reference of loc into a MongoLocator on the last
+// collection of its path.
+func (c *mongoClient) ResolveReference(loc Locator) (Locator, error) {
+	return loc.resolveMongo()
+}
+
+// Name returns "mongodb".
+func (c *mongoClient) Name() string {
+	return "mongodb"
+}
+
+// ValidateLocator checks that loc has a valid MongoLocator.
+func (c *mongoClient) ValidateLocator(loc Locator) []string {
+	return mongoLocatorProblems(loc)
+}
+
+// GetAll reads the locators that filter on _id alone with one Find per
+// collection, using $in on _id. Other locators are read one at a time.
+func (c *mongoClient) GetAll(ctx context.Context, locs []Locator) ([]LocatorAndObject, error) {
+	results := make([]LocatorAndObject, len(locs))
+
+	// group the locators by collection, keeping their positions in locs
+	ids := make(map[string][]interface{})
+	positions := make(map[string]map[string][]int)
+	var collections []string
+	for i, loc := range locs {
+		id, ok := mongoIDFilter(loc.MongoLocator.Filter)
+		if !ok || len(loc.MongoLocator.Where) > 0 {
+			result, err := c.GetDocument(ctx, loc)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result
+			continue
+		}
+		collection := loc.MongoLocator.Collection
+		if positions[collection] == nil {
+			positions[collection] = make(map[string][]int)
+			collections = append(collections, collection)
+		}
+		key := mongoIDKey(id)
+		if len(positions[collection][key]) == 0 {
+			ids[collection] = append(ids[collection], id)
+		}
+		positions[collection][key] = append(positions[collection][key], i)
+	}
+
+	for _, collection := range collections {
+		bsonResults, fingerprints, err := c.findIDs(ctx, collection, ids[collection])
 		if err != nil {
-			return nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+			return nil, err
+		}
+
+		for j, bsonResult := range bsonResults {
+			result := mongoObject(bsonResult)
+			key := mongoIDKey(bsonResult["_id"])
+			for _, i := range positions[collection][key] {
+				loc := locs[i]
+				loc.LocatorType = Document
+				results[i] = LocatorAndObject{Locator: loc, Object: result, Fingerprint: fingerprints[j]}
+			}
+			delete(positions[collection], key)
+		}
+		for _, missing := range positions[collection] {
+			return nil, fmt.Errorf("%s %s: %w", GET_DOCUMENT_ERROR, locs[missing[0]].key(), ErrDocumentNotFound)
 		}
-		convertedResult["_id"] = result["_id"].(primitive.ObjectID).Hex()
-		results = append(results, locatorAndObject{Locator: loc, Object: convertedResult})
 	}
 
 	return results, nil
 }
 
-func (c *mongoClient) updateAndDelete(documentsToUpdate []documentUpdates, nodesToDelete []Locator) {
-	session, err := c.db.Client().StartSession()
+// findIDs reads the documents of collection with the given IDs, and their
+// fingerprints.
+func (c *mongoClient) findIDs(ctx context.Context, collection string, ids []interface{}) ([]bson.M, []string, error) {
+	ctx, cancel := readContext(ctx)
+	defer cancel()
+
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}
+	cursor, err := c.db.Collection(collection).Find(ctx, filter)
 	if err != nil {
-		log.Fatalf("Failed to start session: %v", err)
+		return nil, nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
 	}
-	defer session.EndSession(context.Background())
+	return readCursor(ctx, cursor)
+}
 
-	callback := func(sessionContext mongo.SessionContext) (interface{}, error) {
-		// delete nodes
-		for _, nodeLocator := range nodesToDelete {
-			collection := c.db.Collection(nodeLocator.MongoLocator.Collection)
-			_, err := collection.DeleteOne(sessionContext, nodeLocator.MongoLocator.Filter)
+// readCursor decodes every document of cursor and closes it. It also returns
+// the fingerprint of each document, hashed from the bytes that were decoded.
+func readCursor(ctx context.Context, cursor *mongo.Cursor) ([]bson.M, []string, error) {
+	defer cursor.Close(ctx)
+
+	var bsonResults []bson.M
+	var fingerprints []string
+	for cursor.Next(ctx) {
+		bsonResult := bson.M{}
+		if err := bson.Unmarshal(cursor.Current, &bsonResult); err != nil {
+			return nil, nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+		}
+		bsonResults = append(bsonResults, bsonResult)
+		fingerprints = append(fingerprints, mongoHash(cursor.Current))
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+	return bsonResults, fingerprints, nil
+}
+
+func (c *mongoClient) UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	return c.runTransaction(ctx, func(sessionContext mongo.SessionContext) error {
+		return c.write(sessionContext, documentsToUpdate, nodesToDelete)
+	})
+}
+
+// Fingerprint returns the SHA-256 hash of the BSON encoding of the document
+// loc points to.
+func (c *mongoClient) Fingerprint(ctx context.Context, loc Locator) (string, error) {
+	query, err := loc.MongoLocator.query()
+	if err != nil {
+		return "", fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+	ctx, cancel := readContext(ctx)
+	defer cancel()
+
+	raw, err := c.db.Collection(loc.MongoLocator.Collection).FindOne(ctx, query).DecodeBytes()
+	if err == mongo.ErrNoDocuments {
+		return "", fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, ErrDocumentNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s %w", GET_DOCUMENT_ERROR, err)
+	}
+	return mongoHash(raw), nil
+}
+
+// UpdateAndDeleteIfUnchanged compares the hash of every document read in the
+// transaction with its fingerprint before writing. A document changed by
+// another client after it was read makes the transaction fail with a write
+// conflict.
+func (c *mongoClient) UpdateAndDeleteIfUnchanged(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator, fingerprints map[string]string) error {
+	var stale []Locator
+	err := c.runTransaction(ctx, func(sessionContext mongo.SessionContext) error {
+		stale = nil
+		for _, loc := range writeLocators(documentsToUpdate, nodesToDelete) {
+			query, err := loc.MongoLocator.query()
 			if err != nil {
-				return nil, err
+				return err
+			}
+			raw, err := c.db.Collection(loc.MongoLocator.Collection).FindOne(sessionContext, query).DecodeBytes()
+			if err != nil && err != mongo.ErrNoDocuments {
+				return err
 			}
+			if err == mongo.ErrNoDocuments || mongoHash(raw) != fingerprints[loc.key()] {
+				stale = append(stale, loc)
+			}
+		}
+		if len(stale) > 0 {
+			return &StaleDocumentError{Locators: stale}
+		}
+		return c.write(sessionContext, documentsToUpdate, nodesToDelete)
+	})
+
+	var staleErr *StaleDocumentError
+	if errors.As(err, &staleErr) {
+		return staleErr
+	}
+	return err
+}
+
+// runTransaction runs fn in a transaction.
+func (c *mongoClient) runTransaction(ctx context.Context, fn func(sessionContext mongo.SessionContext) error) error {
+	session, err := c.db.Client().StartSession()
+	if err != nil {
+		return fmt.Errorf("%s failed to start session: %w", WRITE_BATCH_ERROR, err)
+	}
+	defer session.EndSession(ctx)
+
+	callback := func(sessionContext mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessionContext)
+	}
+
+	_, err = session.WithTransaction(ctx, callback)
+	if err != nil {
+		return fmt.Errorf("%s %w", WRITE_BATCH_ERROR, err)
+	}
+	return nil
+}
+
+func (c *mongoClient) write(sessionContext mongo.SessionContext, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	// delete nodes
+	for _, nodeLocator := range nodesToDelete {
+		collection := c.db.Collection(nodeLocator.MongoLocator.Collection)
+		query, err := nodeLocator.MongoLocator.query()
+		if err != nil {
+			return err
 		}
+		_, err = collection.DeleteOne(sessionContext, query)
+		if err != nil {
+			return err
+		}
+	}
 
-		// update nodes
-		for _, update := range documentsToUpdate {
-			collection := c.db.Collection(update.Locator.MongoLocator.Collection)
-			_, err := collection.UpdateOne(sessionContext, update.Locator.MongoLocator.Filter, update.FieldsToUpdate)
+	// update nodes
+	for _, update := range documentsToUpdate {
+		collection := c.db.Collection(update.Locator.MongoLocator.Collection)
+		query, err := update.Locator.MongoLocator.query()
+		if err != nil {
+			return err
+		}
+		mongoUpdates, err := update.FieldsToUpdate.mongoUpdates()
+		if err != nil {
+			return err
+		}
+		for _, mongoUpdate := range mongoUpdates {
+			_, err := collection.UpdateOne(sessionContext, query, mongoUpdate)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
+	}
+
+	return nil
+}
 
-		return nil, nil
+// mongoObject converts a document read from MongoDB to a DatabaseObject of
+// plain Go values, with its _id as a string: the hex form of an ObjectID, or
+// the default format of any other value.
+func mongoObject(bsonResult bson.M) DatabaseObject {
+	result := DatabaseObject(mongoObjectFields(bsonResult))
+	switch id := bsonResult["_id"].(type) {
+	case primitive.ObjectID:
+		result["_id"] = id.Hex()
+	default:
+		result["_id"] = fmt.Sprint(id)
 	}
+	return result
+}
 
-	_, err = session.WithTransaction(context.Background(), callback)
-	if err != nil {
-		log.Fatalf("Transaction failed: %v", err)
+// mongoValue converts a value decoded from BSON to a plain Go value: documents
+// become maps, arrays slices, integers int64, dates and timestamps time.Time,
+// ObjectIDs hex strings, binary data []byte and decimals strings.
+func mongoValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.M:
+		return map[string]interface{}(mongoObjectFields(v))
+	case map[string]interface{}:
+		return map[string]interface{}(mongoObjectFields(v))
+	case bson.D:
+		fields := make(map[string]interface{}, len(v))
+		for _, entry := range v {
+			fields[entry.Key] = mongoValue(entry.Value)
+		}
+		return fields
+	case bson.A:
+		return mongoSlice(v)
+	case []interface{}:
+		return mongoSlice(v)
+	case int32:
+		return int64(v)
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case primitive.Timestamp:
+		return time.Unix(int64(v.T), 0).UTC()
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.Binary:
+		return v.Data
+	case primitive.Decimal128:
+		return v.String()
 	}
+	return value
+}
+
+func mongoObjectFields(doc map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		fields[key] = mongoValue(value)
+	}
+	return fields
+}
+
+func mongoSlice(elems []interface{}) []interface{} {
+	converted := make([]interface{}, len(elems))
+	for i, elem := range elems {
+		converted[i] = mongoValue(elem)
+	}
+	return converted
+}
+
+// mongoIDFilter returns the _id a filter such as {_id: <id>} matches, and
+// false if the filter matches on anything else.
+func mongoIDFilter(filter bson.D) (interface{}, bool) {
+	if len(filter) != 1 || filter[0].Key != "_id" {
+		return nil, false
+	}
+	switch filter[0].Value.(type) {
+	case bson.D, bson.M, map[string]interface{}, primitive.Regex:
+		// operators such as $in, or patterns, may match several documents
+		return nil, false
+	}
+	return filter[0].Value, true
+}
+
+// mongoIDKey returns a string that is equal for equal _id values.
+func mongoIDKey(id interface{}) string {
+	if objectID, ok := id.(primitive.ObjectID); ok {
+		return objectID.Hex()
+	}
+	return fmt.Sprintf("%T %v", id, id)
+}
+
+func mongoHash(raw bson.Raw) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
 }
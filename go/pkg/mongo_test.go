@@ -0,0 +1,65 @@
+package pal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMongoObject(t *testing.T) {
+	createdAt := time.Date(2023, 7, 19, 12, 30, 0, 0, time.UTC)
+	doc := bson.D{
+		{Key: "_id", Value: objectID(t, testUserID)},
+		{Key: "name", Value: "user1"},
+		{Key: "age", Value: int32(5)},
+		{Key: "visits", Value: int64(1) << 40},
+		{Key: "score", Value: 2.5},
+		{Key: "createdAt", Value: primitive.NewDateTimeFromTime(createdAt)},
+		{Key: "gcs", Value: bson.A{objectID(t, testChatID)}},
+		{Key: "settings", Value: bson.D{{Key: "theme", Value: "dark"}, {Key: "size", Value: int32(12)}}},
+	}
+
+	// decode the document as the Mongo backend reads it
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bsonResult := bson.M{}
+	if err := bson.Unmarshal(raw, &bsonResult); err != nil {
+		t.Fatal(err)
+	}
+
+	want := DatabaseObject{
+		"_id":       testUserID,
+		"name":      "user1",
+		"age":       int64(5),
+		"visits":    int64(1) << 40,
+		"score":     2.5,
+		"createdAt": createdAt,
+		"gcs":       []interface{}{testChatID},
+		"settings":  map[string]interface{}{"theme": "dark", "size": int64(12)},
+	}
+	if got := mongoObject(bsonResult); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestMongoObjectID(t *testing.T) {
+	tests := []struct {
+		id   interface{}
+		want string
+	}{
+		{objectID(t, testUserID), testUserID},
+		{"alice", "alice"},
+		{int32(42), "42"},
+	}
+	for _, tt := range tests {
+		got := mongoObject(bson.M{"_id": tt.id, "name": "user"})
+		if got["_id"] != tt.want {
+			t.Errorf("got _id %#v for %#v, want %q", got["_id"], tt.id, tt.want)
+		}
+	}
+}
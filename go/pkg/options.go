@@ -0,0 +1,99 @@
+package pal
+
+// RequestOption configures a single access or deletion request.
+type RequestOption func(*requestOptions)
+
+type requestOptions struct {
+	limits      Limits
+	concurrency int
+	batchSize   int
+	preview     bool
+	plan        bool
+	errorPolicy ErrorPolicy
+	provenance  bool
+}
+
+func newRequestOptions(opts []RequestOption) requestOptions {
+	options := requestOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WithLimits bounds the documents a request may read and the size of the
+// report it may produce. See Limits.
+func WithLimits(limits Limits) RequestOption {
+	return func(options *requestOptions) {
+		options.limits = limits
+	}
+}
+
+// WithConcurrency lets an access request read up to n documents or
+// collections at a time instead of one after the other. The report is the
+// same as without the option. HandleAccess is then called from several
+// goroutines and must be safe for concurrent use; it is still called at most
+// once per document and DataType. Values of n below 2 keep the request serial.
+// Deletion requests ignore this option.
+func WithConcurrency(n int) RequestOption {
+	return func(options *requestOptions) {
+		options.concurrency = n
+	}
+}
+
+// WithBatchSize makes a deletion request write its plan in batches of at most
+// n deletions and updates, each applied in its own transaction, instead of in
+// a single transaction. Use it when a plan may exceed the number of writes a
+// transaction allows, e.g. FirestoreMaxTransactionWrites. If a batch fails,
+// the earlier batches stay applied; DeletionResult records how far the plan
+// got, and ResumeDeletionRequest writes the rest. Access requests ignore this
+// option.
+func WithBatchSize(n int) RequestOption {
+	return func(options *requestOptions) {
+		options.batchSize = n
+	}
+}
+
+// WithPreview makes a deletion request read every document its plan deletes or
+// updates, and record in DeletionResult.Preview what each of them would look
+// like after the plan is written. Combine it with writeToDatabase set to false
+// to review a deletion before carrying it out. Updates are applied the way the
+// client's backend applies them; previewing updates fails on backends other
+// than the Firestore, MongoDB and memory ones. Fields changed by Firestore
+// field transforms, whose effect cannot be simulated, are listed with the
+// FieldNotPreviewable kind. Access requests ignore this option.
+func WithPreview() RequestOption {
+	return func(options *requestOptions) {
+		options.preview = true
+	}
+}
+
+// WithDeletionPlan makes a deletion request record in DeletionResult.Plan a
+// DeletionPlan that can be stored, approved and written later with
+// ApplyDeletionPlan. If the request writes to the database itself, documents
+// that change between reading and writing are not written either. Access
+// requests ignore this option.
+func WithDeletionPlan() RequestOption {
+	return func(options *requestOptions) {
+		options.plan = true
+	}
+}
+
+// WithErrorPolicy selects what an access request does when a document cannot
+// be read or HandleAccess fails on it, instead of failing. Deletion requests
+// ignore this option and always fail, since a partial deletion plan would
+// leave personal data behind.
+func WithErrorPolicy(policy ErrorPolicy) RequestOption {
+	return func(options *requestOptions) {
+		options.errorPolicy = policy
+	}
+}
+
+// WithProvenance makes an access request record where every document in its
+// report comes from, under ProvenanceKey of the object that holds the
+// document's data. Deletion requests ignore this option.
+func WithProvenance() RequestOption {
+	return func(options *requestOptions) {
+		options.provenance = true
+	}
+}
@@ -0,0 +1,315 @@
+package pal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// normalizePlan removes the duplicates a deletion plan collects when the same
+// document is reached along several paths. Each document is deleted at most
+// once, updates to documents that are deleted are dropped, and the updates to
+// each remaining document are merged into a single DocumentUpdates. Documents
+// keep the position of their first occurrence.
+//
+// Repeated updates that have the same effect are kept once, and array removals
+// or unions of the same field in FieldUpdates.Updates are combined, as their
+// order does not matter. Firestore field transforms, such as
+// firestore.ArrayRemove, are opaque, so they are only recognized as repeated
+// if they are equal. Any other pair of updates to the same field, or to a field
+// and one nested in it, is reported in a *PlanConflictError, because the result
+// would depend on the order they are applied in. This includes an update in
+// FieldUpdates.Updates and one in FirestoreUpdates or MongoUpdates, which a
+// backend applies together; FirestoreUpdates and MongoUpdates are never applied
+// by the same backend, so they do not conflict with each other.
+func normalizePlan(documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) ([]DocumentUpdates, []Locator, error) {
+	deleted := make(map[string]bool)
+	normalizedDeletes := make([]Locator, 0, len(nodesToDelete))
+	for _, loc := range nodesToDelete {
+		key := loc.key()
+		if deleted[key] {
+			continue
+		}
+		deleted[key] = true
+		normalizedDeletes = append(normalizedDeletes, loc)
+	}
+
+	positions := make(map[string]int)
+	normalizedUpdates := make([]DocumentUpdates, 0, len(documentsToUpdate))
+	var conflicts []UpdateConflict
+	for _, update := range documentsToUpdate {
+		key := update.Locator.key()
+		if deleted[key] {
+			continue
+		}
+		i, ok := positions[key]
+		if !ok {
+			positions[key] = len(normalizedUpdates)
+			normalizedUpdates = append(normalizedUpdates, DocumentUpdates{Locator: update.Locator})
+			i = len(normalizedUpdates) - 1
+		}
+
+		merged := &normalizedUpdates[i].FieldsToUpdate
+		for _, fieldUpdate := range update.FieldsToUpdate.Updates {
+			if conflict := mergeFieldUpdate(merged, fieldUpdate); conflict != "" {
+				conflicts = append(conflicts, UpdateConflict{Locator: update.Locator, Field: conflict})
+			}
+		}
+		for _, firestoreUpdate := range update.FieldsToUpdate.FirestoreUpdates {
+			if conflict := mergeFirestoreUpdate(merged, firestoreUpdate); conflict != "" {
+				conflicts = append(conflicts, UpdateConflict{Locator: update.Locator, Field: conflict})
+			}
+		}
+		for _, mongoUpdate := range update.FieldsToUpdate.MongoUpdates {
+			fields, ok := mongoUpdateFields(mongoUpdate)
+			if !ok {
+				// pipelines and other updates that are not made of operators
+				// are kept as they are, in order, unless they are repeated
+				if !containsUpdate(merged.MongoUpdates, mongoUpdate) {
+					merged.MongoUpdates = append(merged.MongoUpdates, mongoUpdate)
+				}
+				continue
+			}
+			kept, conflict := mergeMongoUpdate(merged.MongoUpdates, fields)
+			if conflict != "" {
+				conflicts = append(conflicts, UpdateConflict{Locator: update.Locator, Field: conflict})
+			}
+			if len(kept) > 0 {
+				merged.MongoUpdates = append(merged.MongoUpdates, mongoUpdateDocument(kept))
+			}
+		}
+	}
+
+	for _, update := range normalizedUpdates {
+		for _, conflict := range nativeConflicts(update.FieldsToUpdate) {
+			conflicts = append(conflicts, UpdateConflict{Locator: update.Locator, Field: conflict})
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return nil, nil, &PlanConflictError{Conflicts: conflicts}
+	}
+	return normalizedUpdates, normalizedDeletes, nil
+}
+
+// nativeConflicts returns the fields of updates.Updates that an update in
+// FirestoreUpdates or MongoUpdates also changes. The fields changed by Mongo
+// updates that are not made of operators are not known.
+func nativeConflicts(updates FieldUpdates) []string {
+	var native []string
+	for _, update := range updates.FirestoreUpdates {
+		native = append(native, firestoreUpdatePath(update))
+	}
+	for _, update := range updates.MongoUpdates {
+		fields, _ := mongoUpdateFields(update)
+		for _, field := range fields {
+			native = append(native, field.path)
+		}
+	}
+
+	var conflicts []string
+	for _, update := range updates.Updates {
+		path := strings.Join(update.fieldPath(), ".")
+		for _, other := range native {
+			if pathsOverlap(path, other) {
+				conflicts = append(conflicts, path)
+				break
+			}
+		}
+	}
+	return conflicts
+}
+
+// mergeFieldUpdate adds update to merged.Updates, like mergeFirestoreUpdate
+// does for Firestore updates.
+func mergeFieldUpdate(merged *FieldUpdates, update FieldUpdate) (conflict string) {
+	path := strings.Join(update.fieldPath(), ".")
+	for i, existing := range merged.Updates {
+		existingPath := strings.Join(existing.fieldPath(), ".")
+		if !pathsOverlap(path, existingPath) {
+			continue
+		}
+		if path != existingPath || update.Op != existing.Op {
+			return path
+		}
+		if valuesEqual(plainValue(update.Value), plainValue(existing.Value)) && valuesEqual(plainValue(update.Values), plainValue(existing.Values)) {
+			return ""
+		}
+		if update.Op == ArrayRemoveOp || update.Op == ArrayUnionOp {
+			values := append([]interface{}{}, existing.Values...)
+			for _, value := range update.Values {
+				if !containsValue(values, value) {
+					values = append(values, value)
+				}
+			}
+			merged.Updates[i].Values = values
+			return ""
+		}
+		return path
+	}
+	merged.Updates = append(merged.Updates, update)
+	return ""
+}
+
+// mergeFirestoreUpdate adds update to merged, unless an equal update of the
+// same field is already there. It returns the field if the update conflicts
+// with one already in merged.
+func mergeFirestoreUpdate(merged *FieldUpdates, update firestore.Update) (conflict string) {
+	path := firestoreUpdatePath(update)
+	for _, existing := range merged.FirestoreUpdates {
+		existingPath := firestoreUpdatePath(existing)
+		if !pathsOverlap(path, existingPath) {
+			continue
+		}
+		if path == existingPath && reflect.DeepEqual(existing.Value, update.Value) {
+			return ""
+		}
+		return path
+	}
+	merged.FirestoreUpdates = append(merged.FirestoreUpdates, update)
+	return ""
+}
+
+// isFirestoreTransform reports whether value is a field transform of the
+// firestore package, such as firestore.ArrayRemove, other than firestore.Delete
+// and firestore.ServerTimestamp, which are sentinels. Only Firestore can apply
+// transforms, as the firestore package does not expose what they hold.
+func isFirestoreTransform(value interface{}) bool {
+	if value == nil || value == firestore.Delete || value == firestore.ServerTimestamp {
+		return false
+	}
+	return reflect.TypeOf(value).PkgPath() == firestorePackage
+}
+
+var firestorePackage = reflect.TypeOf(firestore.Update{}).PkgPath()
+
+func firestoreUpdatePath(update firestore.Update) string {
+	if len(update.FieldPath) > 0 {
+		return strings.Join(update.FieldPath, ".")
+	}
+	return update.Path
+}
+
+// mongoField is a single field changed by a MongoDB update document, such as
+// "users" in {$pull: {users: "123"}}.
+type mongoField struct {
+	operator string
+	path     string
+	value    interface{}
+}
+
+// mongoUpdateFields returns the fields changed by an update document made of
+// operators, such as {$set: {...}, $pull: {...}}. ok is false for updates of
+// any other shape, such as update pipelines, whose effect normalizePlan does
+// not try to work out.
+func mongoUpdateFields(update interface{}) (fields []mongoField, ok bool) {
+	// toBsonD fails on pipelines, as they are arrays
+	operators, err := toBsonD(update)
+	if err != nil {
+		return nil, false
+	}
+	for _, operator := range operators {
+		values, ok := operator.Value.(bson.D)
+		if !ok || !strings.HasPrefix(operator.Key, "$") {
+			return nil, false
+		}
+		for _, value := range values {
+			fields = append(fields, mongoField{operator: operator.Key, path: value.Key, value: value.Value})
+		}
+	}
+	return fields, true
+}
+
+func containsUpdate(updates []interface{}, update interface{}) bool {
+	for _, other := range updates {
+		if reflect.DeepEqual(other, update) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMongoUpdate returns the fields of an update that do not repeat one of
+// the updates already merged. Array removals and additions of the same field
+// are kept, as they are applied as separate update documents. It returns the
+// field if the update conflicts with one already merged.
+func mergeMongoUpdate(merged []interface{}, fields []mongoField) (kept []mongoField, conflict string) {
+	var existing []mongoField
+	for _, update := range merged {
+		// the effect of updates of other shapes is not known
+		updateFields, _ := mongoUpdateFields(update)
+		existing = append(existing, updateFields...)
+	}
+
+	for _, field := range fields {
+		duplicate := false
+		for _, other := range existing {
+			if !pathsOverlap(field.path, other.path) {
+				continue
+			}
+			if field.path == other.path && field.operator == other.operator {
+				if valuesEqual(plainValue(field.value), plainValue(other.value)) {
+					duplicate = true
+					break
+				}
+				if field.operator == "$pull" || field.operator == "$pullAll" || field.operator == "$addToSet" {
+					continue
+				}
+			}
+			return nil, field.path
+		}
+		if !duplicate {
+			kept = append(kept, field)
+		}
+	}
+	return kept, ""
+}
+
+// mongoUpdateDocument builds an update document from fields, grouping them by
+// operator in the order the operators first appear.
+func mongoUpdateDocument(fields []mongoField) bson.D {
+	var update bson.D
+	for _, field := range fields {
+		i := 0
+		for i < len(update) && update[i].Key != field.operator {
+			i++
+		}
+		if i == len(update) {
+			update = append(update, bson.E{Key: field.operator, Value: bson.D{}})
+		}
+		update[i].Value = append(update[i].Value.(bson.D), bson.E{Key: field.path, Value: field.value})
+	}
+	return update
+}
+
+// pathsOverlap reports whether two dotted field paths are equal or one is
+// nested in the other.
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// writeLocators returns the locators of the deletions, then of the updates, of
+// a deletion plan.
+func writeLocators(documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) []Locator {
+	locs := append([]Locator{}, nodesToDelete...)
+	for _, update := range documentsToUpdate {
+		locs = append(locs, update.Locator)
+	}
+	return locs
+}
+
+// documentHash returns a fingerprint of a document's content: the SHA-256 hash
+// of its fields encoded as JSON with sorted keys.
+func documentHash(doc DatabaseObject) (string, error) {
+	encoded, err := json.Marshal(normalizeValue(map[string]interface{}(doc)))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
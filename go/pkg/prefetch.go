@@ -0,0 +1,323 @@
+package pal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// prefetcher reads documents and runs HandleAccess ahead of an access request
+// traversal, using at most a fixed number of goroutines at a time. The
+// traversal itself stays serial: it still decides, in its usual order, which
+// documents are expanded, referenced or truncated, and only asks the
+// prefetcher for results. That keeps the report identical to the one built
+// without a prefetcher.
+//
+// Every read and every handler call is made at most once per request. A
+// result the traversal needs before a goroutine has produced it is computed
+// by the traversal itself.
+type prefetcher struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	backend       Backend
+	handleAccess  HandleAccessFunc
+	dataSubjectID string
+	limits        Limits
+	workers       chan struct{}
+	wg            sync.WaitGroup
+
+	mu sync.Mutex
+	// reads holds document and collection reads, keyed by readKey
+	reads map[string]*future[[]LocatorAndObject]
+	// handled holds handler results, keyed by handleKey
+	handled map[string]*future[map[string]interface{}]
+	// documents counts the documents read, so that speculative reads stop
+	// once as many documents as the request may read have been read
+	documents int
+}
+
+// future is a result that becomes available once done is closed.
+type future[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+func (f *future[T]) resolve(value T, err error) {
+	f.value, f.err = value, err
+	close(f.done)
+}
+
+func (f *future[T]) wait(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// claim returns the future stored under key, creating it if there is none.
+// owner is true if the caller created it and must resolve it.
+func claim[T any](mu *sync.Mutex, futures map[string]*future[T], key string) (f *future[T], owner bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if f, ok := futures[key]; ok {
+		return f, false
+	}
+	f = &future[T]{done: make(chan struct{})}
+	futures[key] = f
+	return f, true
+}
+
+func newPrefetcher(ctx context.Context, req *accessRequest, concurrency int, limits Limits) *prefetcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &prefetcher{
+		ctx:           ctx,
+		cancel:        cancel,
+		backend:       req.backend,
+		handleAccess:  req.handleAccess,
+		dataSubjectID: req.dataSubjectID,
+		limits:        limits,
+		workers:       make(chan struct{}, concurrency),
+		reads:         make(map[string]*future[[]LocatorAndObject]),
+		handled:       make(map[string]*future[map[string]interface{}]),
+	}
+}
+
+// stop cancels outstanding work and waits for all goroutines to return, so
+// that no handler runs after the request has finished.
+func (p *prefetcher) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// getDocument returns the document loc points to.
+func (p *prefetcher) getDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	f, owner := claim(&p.mu, p.reads, readKey(loc))
+	if owner {
+		p.read(ctx, f, loc)
+	}
+	docs, err := f.wait(ctx)
+	if err != nil {
+		return LocatorAndObject{}, err
+	}
+	return readFor(loc, docs)[0], nil
+}
+
+// getDocuments returns the documents loc points to. With MaxDocuments set,
+// the result is the first MaxDocuments+1 documents, which is a superset of
+// what any point of the traversal may ask for.
+func (p *prefetcher) getDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
+	f, owner := claim(&p.mu, p.reads, readKey(loc))
+	if owner {
+		p.read(ctx, f, loc)
+	}
+	docs, err := f.wait(ctx)
+	return readFor(loc, docs), err
+}
+
+// readFor returns docs, read for a locator that points to the same documents
+// as loc, with the DataType and Context of loc.
+func readFor(loc Locator, docs []LocatorAndObject) []LocatorAndObject {
+	result := make([]LocatorAndObject, len(docs))
+	for i, doc := range docs {
+		doc.Locator.DataType = loc.DataType
+		doc.Locator.Context = loc.Context
+		result[i] = doc
+	}
+	return result
+}
+
+// handle returns the result of HandleAccess for a document, and schedules
+// reads for the locators it returns.
+func (p *prefetcher) handle(loc Locator, obj DatabaseObject, depth int) (map[string]interface{}, error) {
+	f, owner := claim(&p.mu, p.handled, handleKey(loc))
+	if owner {
+		f.resolve(p.handleAccess(p.dataSubjectID, loc, obj))
+	}
+	data, err := f.wait(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.prefetch(data, depth)
+	return data, nil
+}
+
+func (p *prefetcher) read(ctx context.Context, f *future[[]LocatorAndObject], loc Locator) {
+	if loc.LocatorType == Document {
+		doc, err := p.backend.GetDocument(ctx, loc)
+		p.addDocuments(1)
+		f.resolve([]LocatorAndObject{doc}, err)
+		return
+	}
+
+	if p.limits.MaxDocuments > 0 {
+		ctx = withFetchLimit(ctx, p.limits.MaxDocuments+1)
+	}
+	docs, err := p.backend.GetDocuments(ctx, loc)
+	p.addDocuments(len(docs))
+	f.resolve(docs, err)
+}
+
+// prefetch starts reading the documents that the locators in data, returned
+// for a document at depth, point to.
+func (p *prefetcher) prefetch(data map[string]interface{}, depth int) {
+	for _, key := range sortedKeys(data) {
+		switch value := data[key].(type) {
+		case Locator:
+			p.schedule([]Locator{value}, depth+1)
+		case []Locator:
+			p.schedule(value, depth+1)
+		case map[string]Locator:
+			siblings := make([]Locator, 0, len(value))
+			for _, k := range sortedKeys(value) {
+				siblings = append(siblings, value[k])
+			}
+			p.schedule(siblings, depth+1)
+		}
+	}
+}
+
+// schedule reads the sibling locators locs, found at depth, on worker
+// goroutines, then handles the documents read and schedules the locators they
+// lead to in turn. If the backend is a BatchBackend, the Document locators
+// among locs are read together by a single worker.
+func (p *prefetcher) schedule(locs []Locator, depth int) {
+	if p.limits.MaxDepth > 0 && depth > p.limits.MaxDepth {
+		return
+	}
+	if p.budgetSpent() {
+		return
+	}
+
+	batch, _ := p.backend.(BatchBackend)
+	var documents []Locator
+	var documentFutures []*future[[]LocatorAndObject]
+	for _, loc := range locs {
+		loc := loc
+		if len(locatorProblems(p.backend, loc)) > 0 {
+			continue
+		}
+		f, owner := claim(&p.mu, p.reads, readKey(loc))
+		if !owner {
+			continue
+		}
+		if batch != nil && loc.LocatorType == Document {
+			documents = append(documents, loc)
+			documentFutures = append(documentFutures, f)
+			continue
+		}
+		p.start([]Locator{loc}, []*future[[]LocatorAndObject]{f}, depth, func() {
+			p.read(p.ctx, f, loc)
+		})
+	}
+
+	if len(documents) == 1 {
+		p.start(documents, documentFutures, depth, func() {
+			p.read(p.ctx, documentFutures[0], documents[0])
+		})
+	} else if len(documents) > 1 {
+		p.start(documents, documentFutures, depth, func() {
+			p.readAll(batch, documents, documentFutures)
+		})
+	}
+}
+
+// start calls read on a worker goroutine, then handles the documents each of
+// futures resolves to. read must resolve every future.
+func (p *prefetcher) start(locs []Locator, futures []*future[[]LocatorAndObject], depth int, read func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case p.workers <- struct{}{}:
+		case <-p.ctx.Done():
+			for _, f := range futures {
+				f.resolve(nil, p.ctx.Err())
+			}
+			return
+		}
+		defer func() { <-p.workers }()
+
+		read()
+		for i, f := range futures {
+			p.expand(locs[i], f, depth)
+		}
+	}()
+}
+
+// readAll reads the documents locs point to with one GetAll call and resolves
+// their futures.
+func (p *prefetcher) readAll(batch BatchBackend, locs []Locator, futures []*future[[]LocatorAndObject]) {
+	docs, err := batch.GetAll(p.ctx, locs)
+	if err != nil {
+		// read each document on its own, so that only the future of the
+		// document that failed holds the error
+		for i, loc := range locs {
+			p.read(p.ctx, futures[i], loc)
+		}
+		return
+	}
+	p.addDocuments(len(docs))
+	for i, f := range futures {
+		f.resolve(docs[i:i+1], nil)
+	}
+}
+
+// expand handles the documents read for loc, unless the traversal or another
+// goroutine already did, and schedules the locators they lead to.
+func (p *prefetcher) expand(loc Locator, f *future[[]LocatorAndObject], depth int) {
+	if f.err != nil {
+		return
+	}
+	for _, doc := range f.value {
+		if p.ctx.Err() != nil {
+			return
+		}
+		handleLoc := loc
+		if loc.LocatorType == Collection {
+			handleLoc = doc.Locator
+		}
+		hf, owner := claim(&p.mu, p.handled, handleKey(handleLoc))
+		if !owner {
+			continue
+		}
+		data, err := p.handleAccess(p.dataSubjectID, handleLoc, doc.Object)
+		hf.resolve(data, err)
+		if err == nil {
+			p.prefetch(data, depth)
+		}
+	}
+}
+
+func (p *prefetcher) addDocuments(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.documents += n
+}
+
+func (p *prefetcher) budgetSpent() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.limits.MaxDocuments > 0 && p.documents >= p.limits.MaxDocuments
+}
+
+// readKey identifies a read: a document, or a collection query including its
+// filters.
+func readKey(loc Locator) string {
+	if loc.LocatorType == Document {
+		return "document " + loc.key()
+	}
+	return fmt.Sprintf("collection %s %v", loc.key(), loc.Filters)
+}
+
+// handleKey identifies a handler call. HandleAccess may treat the same
+// document differently depending on the locator's DataType and Context.
+func handleKey(loc Locator) string {
+	if loc.Context == nil {
+		return loc.DataType + " " + loc.key()
+	}
+	return fmt.Sprintf("%s %s %v", loc.DataType, loc.key(), loc.Context)
+}
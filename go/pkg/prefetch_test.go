@@ -0,0 +1,125 @@
+package pal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowBackend delays every read and records the largest number of reads in
+// flight at once.
+type slowBackend struct {
+	Backend
+	delay time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (b *slowBackend) begin() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight++
+	if b.inFlight > b.peak {
+		b.peak = b.inFlight
+	}
+}
+
+func (b *slowBackend) end() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight--
+}
+
+func (b *slowBackend) GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	b.begin()
+	defer b.end()
+	time.Sleep(b.delay)
+	return b.Backend.GetDocument(ctx, loc)
+}
+
+func (b *slowBackend) GetDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
+	b.begin()
+	defer b.end()
+	time.Sleep(b.delay)
+	return b.Backend.GetDocuments(ctx, loc)
+}
+
+// newGeneratedFriendsBackend seeds n users, each the friend of the next three,
+// and a chat for every pair of neighbouring users.
+func newGeneratedFriendsBackend(t *testing.T, n int) *MemoryBackend {
+	backend := NewMemoryBackend(FirestoreStyle)
+	for i := 0; i < n; i++ {
+		friends := []interface{}{}
+		for j := 1; j <= 3; j++ {
+			friends = append(friends, fmt.Sprintf("u%d", (i+j)%n))
+		}
+		docs := map[string]map[string]interface{}{
+			fmt.Sprintf("users/u%d", i): {"name": fmt.Sprintf("user%d", i), "friends": friends},
+			fmt.Sprintf("chats/c%d", i): {"title": fmt.Sprintf("chat%d", i), "users": []interface{}{fmt.Sprintf("u%d", i), fmt.Sprintf("u%d", (i+1)%n)}},
+		}
+		for path, doc := range docs {
+			if err := backend.Put(path, doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return backend
+}
+
+func TestAccessRequestConcurrency(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend *MemoryBackend
+		limits  Limits
+	}{
+		{"friends", newFriendsBackend(t), Limits{}},
+		{"generated", newGeneratedFriendsBackend(t, 40), Limits{}},
+		{"max depth", newGeneratedFriendsBackend(t, 40), Limits{MaxDepth: 3, OnLimit: TruncateOnLimit}},
+		{"max documents", newGeneratedFriendsBackend(t, 40), Limits{MaxDocuments: 25, OnLimit: TruncateOnLimit}},
+		{"max report bytes", newGeneratedFriendsBackend(t, 40), Limits{MaxReportBytes: 200, OnLimit: TruncateOnLimit}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := NewClient(tt.backend).ProcessAccessRequest(handleAccessFriends, friendsSubject("u1"), "u1", WithLimits(tt.limits))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			const concurrency = 4
+			backend := &slowBackend{Backend: tt.backend, delay: time.Millisecond}
+			var mu sync.Mutex
+			calls := make(map[string]int)
+			handleAccess := func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+				mu.Lock()
+				calls[handleKey(currentDbObjLocator)]++
+				mu.Unlock()
+				return handleAccessFriends(dataSubjectId, currentDbObjLocator, dbObj)
+			}
+
+			got, err := NewClient(backend).ProcessAccessRequest(handleAccess, friendsSubject("u1"), "u1", WithLimits(tt.limits), WithConcurrency(concurrency))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("concurrent report differs from serial report:\ngot  %v\nwant %v", got, want)
+			}
+			for key, n := range calls {
+				if n > 1 {
+					t.Errorf("HandleAccess called %d times for %s", n, key)
+				}
+			}
+			// the data subject is read outside the worker pool
+			if backend.peak > concurrency+1 {
+				t.Errorf("got %d reads in flight, want at most %d", backend.peak, concurrency+1)
+			}
+			if tt.name == "generated" && backend.peak < 2 {
+				t.Errorf("got %d reads in flight, want reads to overlap", backend.peak)
+			}
+		})
+	}
+}
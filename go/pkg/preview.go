@@ -0,0 +1,260 @@
+package pal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// DeletionPreview shows what a deletion plan would do to each document it
+// touches. See WithPreview.
+type DeletionPreview struct {
+	Documents []DocumentPreview `json:"documents"`
+}
+
+// DocumentPreview is a document a deletion plan deletes or updates, as it is
+// now and as it would be after the plan is written. Its Locator is encoded in
+// JSON as in a DeletionPlan.
+type DocumentPreview struct {
+	Locator Locator `json:"locator"`
+	// Deleted is true if the document would be deleted. After and Changes are
+	// then empty.
+	Deleted bool           `json:"deleted"`
+	Before  DatabaseObject `json:"before"`
+	After   DatabaseObject `json:"after,omitempty"`
+	// Changes lists the fields an update would change, in order of path.
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+// FieldChangeKind tells how an update changes a field.
+type FieldChangeKind string
+
+const (
+	FieldAdded   FieldChangeKind = "added"
+	FieldRemoved FieldChangeKind = "removed"
+	FieldChanged FieldChangeKind = "changed"
+	// FieldNotPreviewable marks a field changed by a Firestore field
+	// transform, such as firestore.ArrayRemove, whose effect cannot be
+	// simulated. Before then holds the current value of the field.
+	FieldNotPreviewable FieldChangeKind = "not previewable"
+)
+
+// FieldChange is a field whose value an update changes. Fields of nested
+// objects are listed individually, with dotted paths such as "profile.city".
+type FieldChange struct {
+	Path   string          `json:"path"`
+	Kind   FieldChangeKind `json:"kind"`
+	Before interface{}     `json:"before,omitempty"`
+	After  interface{}     `json:"after,omitempty"`
+}
+
+// updateStyler is implemented by backends whose updates a preview can
+// simulate. updateStyle tells whether they apply updates like Firestore, i.e.
+// FieldUpdates.Updates and FirestoreUpdates, or like MongoDB, i.e.
+// FieldUpdates.Updates and MongoUpdates.
+type updateStyler interface {
+	updateStyle() MemoryStyle
+}
+
+func (c *firestoreClient) updateStyle() MemoryStyle { return FirestoreStyle }
+func (c *mongoClient) updateStyle() MemoryStyle     { return MongoStyle }
+func (m *MemoryBackend) updateStyle() MemoryStyle   { return m.style }
+
+// previewPlan reads every document of a deletion plan and applies its updates
+// to a copy in memory, the way backend would apply them.
+func previewPlan(ctx context.Context, backend Backend, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) (*DeletionPreview, error) {
+	styler, ok := backend.(updateStyler)
+	if !ok && len(documentsToUpdate) > 0 {
+		return nil, fmt.Errorf("%s cannot preview the updates of a %T backend", DELETION_REQUEST_ERROR, backend)
+	}
+	preview := &DeletionPreview{Documents: make([]DocumentPreview, 0, len(nodesToDelete)+len(documentsToUpdate))}
+
+	for _, loc := range nodesToDelete {
+		locAndObj, err := backend.GetDocument(ctx, loc)
+		if err != nil {
+			return nil, err
+		}
+		preview.Documents = append(preview.Documents, DocumentPreview{Locator: loc, Deleted: true, Before: locAndObj.Object})
+	}
+
+	for _, update := range documentsToUpdate {
+		locAndObj, err := backend.GetDocument(ctx, update.Locator)
+		if err != nil {
+			return nil, err
+		}
+		fieldsToUpdate, transforms := splitFirestoreTransforms(update.FieldsToUpdate)
+		after := copyValue(map[string]interface{}(locAndObj.Object)).(map[string]interface{})
+		if err := applyUpdates(after, fieldsToUpdate, styler.updateStyle()); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", DELETION_REQUEST_ERROR, update.Locator.key(), err)
+		}
+		changes := diffFields("", locAndObj.Object, after)
+		if styler.updateStyle() == FirestoreStyle {
+			changes = notPreviewable(changes, transforms, locAndObj.Object)
+		}
+		preview.Documents = append(preview.Documents, DocumentPreview{
+			Locator: update.Locator,
+			Before:  locAndObj.Object,
+			After:   after,
+			Changes: changes,
+		})
+	}
+
+	return preview, nil
+}
+
+// splitFirestoreTransforms returns updates without its Firestore field
+// transforms, and the transforms.
+func splitFirestoreTransforms(updates FieldUpdates) (FieldUpdates, []firestore.Update) {
+	var transforms []firestore.Update
+	var kept []firestore.Update
+	for _, update := range updates.FirestoreUpdates {
+		if isFirestoreTransform(update.Value) {
+			transforms = append(transforms, update)
+		} else {
+			kept = append(kept, update)
+		}
+	}
+	updates.FirestoreUpdates = kept
+	return updates, transforms
+}
+
+// notPreviewable adds to changes the fields changed by transforms, in order of
+// path, replacing the changes already listed for them.
+func notPreviewable(changes []FieldChange, transforms []firestore.Update, before map[string]interface{}) []FieldChange {
+	if len(transforms) == 0 {
+		return changes
+	}
+	for _, transform := range transforms {
+		path := firestoreUpdatePath(transform)
+		kept := changes[:0]
+		for _, change := range changes {
+			if !pathsOverlap(change.Path, path) {
+				kept = append(kept, change)
+			}
+		}
+		value, _ := lookupField(before, strings.Split(path, "."))
+		changes = append(kept, FieldChange{Path: path, Kind: FieldNotPreviewable, Before: value})
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// diffFields returns the changes between two versions of an object, with the
+// paths of its fields prefixed by prefix.
+func diffFields(prefix string, before, after map[string]interface{}) []FieldChange {
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+
+	var changes []FieldChange
+	for _, key := range sortedKeys(keys) {
+		path := prefix + key
+		beforeValue, inBefore := before[key]
+		afterValue, inAfter := after[key]
+		switch {
+		case !inBefore:
+			changes = append(changes, FieldChange{Path: path, Kind: FieldAdded, After: afterValue})
+		case !inAfter:
+			changes = append(changes, FieldChange{Path: path, Kind: FieldRemoved, Before: beforeValue})
+		case valuesEqual(beforeValue, afterValue):
+		default:
+			beforeFields, beforeIsMap := toMap(beforeValue)
+			afterFields, afterIsMap := toMap(afterValue)
+			if beforeIsMap && afterIsMap {
+				changes = append(changes, diffFields(path+".", beforeFields, afterFields)...)
+				continue
+			}
+			changes = append(changes, FieldChange{Path: path, Kind: FieldChanged, Before: beforeValue, After: afterValue})
+		}
+	}
+	return changes
+}
+
+// WriteText writes p to w in a form meant for review: every deleted document
+// in full, and every changed field of the updated documents.
+//
+//	DELETE users/123 (user)
+//	  name: "user1"
+//	UPDATE gcs/abc (groupchat)
+//	  ~ users: ["123","456"] -> ["456"]
+func (p *DeletionPreview) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, doc := range p.Documents {
+		if doc.Deleted {
+			fmt.Fprintf(&b, "DELETE %s (%s)\n", doc.Locator.key(), doc.Locator.DataType)
+			for _, key := range sortedKeys(doc.Before) {
+				fmt.Fprintf(&b, "  %s: %s\n", key, previewValue(doc.Before[key]))
+			}
+			continue
+		}
+
+		fmt.Fprintf(&b, "UPDATE %s (%s)\n", doc.Locator.key(), doc.Locator.DataType)
+		if len(doc.Changes) == 0 {
+			b.WriteString("  no changes\n")
+		}
+		for _, change := range doc.Changes {
+			switch change.Kind {
+			case FieldAdded:
+				fmt.Fprintf(&b, "  + %s: %s\n", change.Path, previewValue(change.After))
+			case FieldRemoved:
+				fmt.Fprintf(&b, "  - %s: %s\n", change.Path, previewValue(change.Before))
+			case FieldNotPreviewable:
+				fmt.Fprintf(&b, "  ? %s: not previewable, changed by a Firestore field transform\n", change.Path)
+			default:
+				fmt.Fprintf(&b, "  ~ %s: %s -> %s\n", change.Path, previewValue(change.Before), previewValue(change.After))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func previewValue(value interface{}) string {
+	if encoded, err := json.Marshal(plainValue(value)); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// plainDocumentPreview has the fields of a DocumentPreview, but not its JSON
+// methods.
+type plainDocumentPreview DocumentPreview
+
+// documentPreviewJSON is the JSON form of a DocumentPreview. Its Locator
+// shadows the one of the embedded plainDocumentPreview.
+type documentPreviewJSON struct {
+	plainDocumentPreview
+	Locator locatorJSON `json:"locator"`
+}
+
+func (p DocumentPreview) MarshalJSON() ([]byte, error) {
+	encoded := documentPreviewJSON{plainDocumentPreview: plainDocumentPreview(p)}
+	var err error
+	if encoded.Locator, err = encodeLocator(p.Locator); err != nil {
+		return nil, err
+	}
+	return json.Marshal(encoded)
+}
+
+func (p *DocumentPreview) UnmarshalJSON(data []byte) error {
+	var encoded documentPreviewJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	preview := DocumentPreview(encoded.plainDocumentPreview)
+	var err error
+	if preview.Locator, err = decodeLocator(encoded.Locator); err != nil {
+		return err
+	}
+	*p = preview
+	return nil
+}
@@ -0,0 +1,56 @@
+package pal
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DataTypeKey is the key under which an access request records the DataType
+// of every document in the report, next to the data HandleAccess returned for
+// it, e.g. {"$dataType": "message"}. Unlike ProvenanceKey, it is always
+// present.
+const DataTypeKey = "$dataType"
+
+// ProvenanceKey is the key under which an access request made WithProvenance
+// records where a document in the report comes from, next to the data
+// HandleAccess returned for it, e.g.
+//
+//	{"$provenance": {"backend": "firestore", "collection": "gcs/abc/messages",
+//	  "documentId": "123", "dataType": "message", "path": "Groupchats[0].Messages[1]"}}
+//
+// "backend" is the name of the backend, see NamedBackend. "collection" is the
+// Firestore collection path or the MongoDB collection, whichever loc uses.
+// "path" is the chain of report keys from the data subject down to the
+// document, in the form of TraversalError.Path; it is empty for the data
+// subject.
+const ProvenanceKey = "$provenance"
+
+func provenance(backend Backend, dataNode DatabaseObject, loc Locator, path string) map[string]interface{} {
+	name := "unknown"
+	if named, ok := backend.(NamedBackend); ok {
+		name = named.Name()
+	}
+	collection := loc.MongoLocator.Collection
+	if collectionPath := loc.FirestoreLocator.CollectionPath; len(collectionPath) > 0 {
+		collection = firestorePath(collectionPath, loc.DocIDs[:len(collectionPath)-1])
+	}
+	return map[string]interface{}{
+		"backend":    name,
+		"collection": collection,
+		"documentId": documentID(dataNode["_id"]),
+		"dataType":   loc.DataType,
+		"path":       path,
+	}
+}
+
+// documentID returns the _id of a document as a string.
+func documentID(id interface{}) string {
+	switch id := id.(type) {
+	case string:
+		return id
+	case primitive.ObjectID:
+		return id.Hex()
+	}
+	return fmt.Sprint(id)
+}
@@ -0,0 +1,85 @@
+package pal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	provenanceOf := func(backend, collection, id, dataType, path string) map[string]interface{} {
+		return map[string]interface{}{"backend": backend, "collection": collection, "documentId": id, "dataType": dataType, "path": path}
+	}
+	report := func(backend, chats, messages string) map[string]interface{} {
+		return map[string]interface{}{
+			"Name": "user1",
+			"Groupchats": []interface{}{
+				map[string]interface{}{
+					"Messages": []interface{}{
+						map[string]interface{}{"Content": "hello", DataTypeKey: "message", ProvenanceKey: provenanceOf(backend, messages, "m1", "message", "Groupchats[0].Messages[0]")},
+						map[string]interface{}{"Content": "how are you?", DataTypeKey: "message", ProvenanceKey: provenanceOf(backend, messages, "m3", "message", "Groupchats[0].Messages[1]")},
+					},
+					DataTypeKey:   "groupchat",
+					ProvenanceKey: provenanceOf(backend, chats, testChatID, "groupchat", "Groupchats[0]"),
+				},
+			},
+			DataTypeKey:   "user",
+			ProvenanceKey: provenanceOf(backend, "users", testUserID, "user", ""),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		backend func(*testing.T) Backend
+		want    map[string]interface{}
+	}{
+		{"firestore", func(t *testing.T) Backend { return newTestFirestoreBackend(t) }, report("memory", "gcs", "gcs/"+testChatID+"/messages")},
+		{"mongo", func(t *testing.T) Backend { return newTestMongoBackend(t) }, report("memory", "gcs", "messages")},
+		{"unnamed", func(t *testing.T) Backend { return unnamedBackend{newTestMongoBackend(t)} }, report("unknown", "gcs", "messages")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(tt.backend(t))
+			subject := Ref("users", testUserID).Locator("user")
+			got, err := client.ProcessAccessRequest(refHandleAccess, subject, testUserID, WithProvenance())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got report %v, want %v", got, tt.want)
+			}
+
+			plain, err := client.ProcessAccessRequest(refHandleAccess, subject, testUserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := plain[ProvenanceKey]; ok {
+				t.Error("got provenance without WithProvenance")
+			}
+			if got := plain[DataTypeKey]; got != "user" {
+				t.Errorf("got data type %v without WithProvenance, want user", got)
+			}
+		})
+	}
+}
+
+// unnamedBackend is a custom Backend that does not implement NamedBackend.
+type unnamedBackend struct {
+	backend *MemoryBackend
+}
+
+func (b unnamedBackend) GetDocument(ctx context.Context, loc Locator) (LocatorAndObject, error) {
+	return b.backend.GetDocument(ctx, loc)
+}
+
+func (b unnamedBackend) GetDocuments(ctx context.Context, loc Locator) ([]LocatorAndObject, error) {
+	return b.backend.GetDocuments(ctx, loc)
+}
+
+func (b unnamedBackend) UpdateAndDelete(ctx context.Context, documentsToUpdate []DocumentUpdates, nodesToDelete []Locator) error {
+	return b.backend.UpdateAndDelete(ctx, documentsToUpdate, nodesToDelete)
+}
+
+func (b unnamedBackend) ResolveReference(loc Locator) (Locator, error) {
+	return b.backend.ResolveReference(loc)
+}
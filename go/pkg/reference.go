@@ -0,0 +1,234 @@
+package pal
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reference points to a document or a collection without committing to a
+// backend, so that the same handlers work on Firestore and MongoDB. Build one
+// with Ref or CollectionRef and turn it into a Locator with Locator:
+//
+//	pal.Ref("gcs", chatID).Sub("messages").ParentField("chatId").Where("userId", "==", id).Locator("message")
+//
+// The backend resolves the reference when the locator is first used. Firestore
+// uses the path as is. MongoDB has no nested collections, so a collection
+// reached through Sub is a top-level collection whose documents hold the ID of
+// their parent in the field named by ParentField, as a string. Document IDs
+// that are valid ObjectID hex strings are matched against _id as ObjectIDs,
+// and any other ID against a string _id, so a malformed ObjectID is not an
+// error but matches no document.
+type Reference struct {
+	collections []string
+	ids         []string
+	parentField string
+	filters     []Filter
+	err         error
+}
+
+// Ref returns a reference to the document with the given ID in a top-level
+// collection.
+func Ref(collection string, id string) Reference {
+	return CollectionRef(collection).Doc(id)
+}
+
+// CollectionRef returns a reference to a top-level collection.
+func CollectionRef(collection string) Reference {
+	return Reference{collections: []string{collection}}
+}
+
+// Doc returns a reference to the document with the given ID in the collection r
+// points to.
+func (r Reference) Doc(id string) Reference {
+	if r.isDocument() {
+		return r.fail(fmt.Errorf("Doc(%q) needs a collection reference", id))
+	}
+	r.ids = append(append([]string{}, r.ids...), id)
+	return r
+}
+
+// Sub returns a reference to a collection nested in the document r points to.
+func (r Reference) Sub(collection string) Reference {
+	if !r.isDocument() {
+		return r.fail(fmt.Errorf("Sub(%q) needs a document reference", collection))
+	}
+	r.collections = append(append([]string{}, r.collections...), collection)
+	r.filters = nil
+	return r
+}
+
+// ParentField names the field that holds the ID of the parent document in a
+// collection reached through Sub. It is only used by MongoDB.
+func (r Reference) ParentField(field string) Reference {
+	r.parentField = field
+	return r
+}
+
+// Where returns a reference to the documents of the collection r points to
+// whose field at path compares to value with op. Operators are those of
+// Filter.
+func (r Reference) Where(path string, op string, value interface{}) Reference {
+	if r.isDocument() {
+		return r.fail(fmt.Errorf("Where(%q) needs a collection reference", path))
+	}
+	r.filters = append(append([]Filter{}, r.filters...), Filter{Path: path, Op: op, Value: value})
+	return r
+}
+
+// Locator returns a locator of the given DataType for r. It is a Document
+// locator if r points to a document, and a Collection locator otherwise.
+func (r Reference) Locator(dataType string) Locator {
+	locatorType := Collection
+	if r.isDocument() {
+		locatorType = Document
+	}
+	return Locator{LocatorType: locatorType, DataType: dataType, Ref: &r}
+}
+
+func (r Reference) isDocument() bool {
+	return len(r.ids) == len(r.collections)
+}
+
+func (r Reference) fail(err error) Reference {
+	if r.err == nil {
+		r.err = err
+	}
+	return r
+}
+
+// String returns the Firestore-style path of r, such as "gcs/abc/messages".
+func (r Reference) String() string {
+	return firestorePath(r.collections, r.ids)
+}
+
+// resolveFirestore returns loc with its reference turned into a
+// FirestoreLocator.
+func (loc Locator) resolveFirestore() (Locator, error) {
+	ref := loc.Ref
+	if ref.err != nil {
+		return Locator{}, ref.err
+	}
+	loc.FirestoreLocator = FirestoreLocator{
+		CollectionPath: ref.collections,
+		DocIDs:         ref.ids,
+		Filters:        ref.filters,
+	}
+	loc.Ref = nil
+	return loc, nil
+}
+
+// resolveMongo returns loc with its reference turned into a MongoLocator.
+func (loc Locator) resolveMongo() (Locator, error) {
+	ref := loc.Ref
+	if ref.err != nil {
+		return Locator{}, ref.err
+	}
+	n := len(ref.collections)
+	mongoLocator := MongoLocator{Collection: ref.collections[n-1]}
+	switch {
+	case ref.isDocument():
+		mongoLocator.Filter = bson.D{{Key: "_id", Value: mongoID(ref.ids[n-1])}}
+	case n > 1:
+		if ref.parentField == "" {
+			return Locator{}, fmt.Errorf("reference %s needs a ParentField to be resolved in MongoDB", ref)
+		}
+		mongoLocator.Where = []Filter{{Path: ref.parentField, Op: "==", Value: ref.ids[n-2]}}
+	}
+	mongoLocator.Where = append(mongoLocator.Where, ref.filters...)
+	if _, err := mongoLocator.query(); err != nil {
+		return Locator{}, fmt.Errorf("reference %s: %w", ref, err)
+	}
+	loc.MongoLocator = mongoLocator
+	loc.Ref = nil
+	return loc, nil
+}
+
+// mongoID returns the value a MongoDB _id holds for id: an ObjectID if id is a
+// valid ObjectID hex string, and id itself otherwise.
+func mongoID(id string) interface{} {
+	if objectID, err := primitive.ObjectIDFromHex(id); err == nil {
+		return objectID
+	}
+	return id
+}
+
+// resolveLocator returns loc resolved by backend if it was built from a
+// Reference, and loc itself otherwise.
+func resolveLocator(backend Backend, loc Locator) (Locator, error) {
+	if loc.Ref == nil {
+		return loc, nil
+	}
+	resolver, ok := backend.(ReferenceResolver)
+	if !ok {
+		return Locator{}, fmt.Errorf("backend %T cannot resolve reference %s", backend, loc.Ref)
+	}
+	return resolver.ResolveReference(loc)
+}
+
+// resolveLocators returns locs with every locator built from a Reference
+// resolved by backend. locs itself is not modified.
+func resolveLocators(backend Backend, locs []Locator) ([]Locator, error) {
+	var resolved []Locator
+	for i, loc := range locs {
+		if loc.Ref == nil {
+			continue
+		}
+		if resolved == nil {
+			resolved = append([]Locator{}, locs...)
+		}
+		var err error
+		if resolved[i], err = resolveLocator(backend, loc); err != nil {
+			return nil, err
+		}
+	}
+	if resolved == nil {
+		return locs, nil
+	}
+	return resolved, nil
+}
+
+// resolvingAccessHandler wraps handleAccess so that the locators it returns
+// are resolved by backend.
+func resolvingAccessHandler(backend Backend, handleAccess HandleAccessFunc) HandleAccessFunc {
+	return func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+		data, err := handleAccess(dataSubjectId, currentDbObjLocator, dbObj)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range data {
+			switch value := value.(type) {
+			case Locator:
+				data[key], err = resolveLocator(backend, value)
+			case []Locator:
+				data[key], err = resolveLocators(backend, value)
+			case map[string]Locator:
+				resolved := make(map[string]Locator, len(value))
+				for k, loc := range value {
+					if resolved[k], err = resolveLocator(backend, loc); err != nil {
+						break
+					}
+				}
+				data[key] = resolved
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return data, nil
+	}
+}
+
+// resolvingDeletionHandler wraps handleDeletion so that the locators it
+// returns are resolved by backend.
+func resolvingDeletionHandler(backend Backend, handleDeletion HandleDeletionFunc) HandleDeletionFunc {
+	return func(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+		nodesToTraverse, deleteNode, fieldsToUpdate, err := handleDeletion(dataSubjectId, currentDbObjLocator, dbObj)
+		if err != nil {
+			return nil, false, FieldUpdates{}, err
+		}
+		nodesToTraverse, err = resolveLocators(backend, nodesToTraverse)
+		return nodesToTraverse, deleteNode, fieldsToUpdate, err
+	}
+}
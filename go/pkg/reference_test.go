@@ -0,0 +1,132 @@
+package pal
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func refHandleAccess(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) (map[string]interface{}, error) {
+	switch currentDbObjLocator.DataType {
+	case "user":
+		chats := make([]Locator, 0)
+		for _, id := range dbObj["gcs"].([]interface{}) {
+			chats = append(chats, Ref("gcs", id.(string)).Locator("groupchat"))
+		}
+		return map[string]interface{}{"Name": dbObj["name"], "Groupchats": chats}, nil
+	case "groupchat":
+		messages := Ref("gcs", dbObj["_id"].(string)).Sub("messages").ParentField("chatId").Where("userId", "==", dataSubjectId)
+		return map[string]interface{}{"Messages": messages.Locator("message")}, nil
+	case "message":
+		return map[string]interface{}{"Content": dbObj["content"]}, nil
+	}
+	return nil, fmt.Errorf("invalid data type %s", currentDbObjLocator.DataType)
+}
+
+func refHandleDeletion(dataSubjectId string, currentDbObjLocator Locator, dbObj DatabaseObject) ([]Locator, bool, FieldUpdates, error) {
+	switch currentDbObjLocator.DataType {
+	case "user":
+		return []Locator{Ref("gcs", testChatID).Locator("groupchat")}, true, FieldUpdates{}, nil
+	case "groupchat":
+		messages := Ref("gcs", dbObj["_id"].(string)).Sub("messages").ParentField("chatId").Where("userId", "==", dataSubjectId)
+		updates := FieldUpdates{Updates: []FieldUpdate{ArrayRemove("users", dataSubjectId)}}
+		return []Locator{messages.Locator("message")}, false, updates, nil
+	default:
+		return nil, true, FieldUpdates{}, nil
+	}
+}
+
+func TestReference(t *testing.T) {
+	wantReport := map[string]interface{}{
+		"Name": "user1",
+		"Groupchats": []interface{}{
+			map[string]interface{}{
+				"Messages": []interface{}{
+					map[string]interface{}{"Content": "hello", DataTypeKey: "message"},
+					map[string]interface{}{"Content": "how are you?", DataTypeKey: "message"},
+				},
+				DataTypeKey: "groupchat",
+			},
+		},
+		DataTypeKey: "user",
+	}
+
+	tests := []struct {
+		name     string
+		backend  func(*testing.T) *MemoryBackend
+		messages []string
+	}{
+		{"firestore", newTestFirestoreBackend, []string{"gcs/" + testChatID + "/messages/m1", "gcs/" + testChatID + "/messages/m2", "gcs/" + testChatID + "/messages/m3"}},
+		{"mongo", newTestMongoBackend, []string{"messages/m1", "messages/m2", "messages/m3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := tt.backend(t)
+			client := NewClient(backend)
+			subject := Ref("users", testUserID).Locator("user")
+
+			report, err := client.ProcessAccessRequest(refHandleAccess, subject, testUserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report, wantReport) {
+				t.Errorf("got report %v, want %v", report, wantReport)
+			}
+
+			if _, err := client.ProcessDeletionRequest(refHandleDeletion, subject, testUserID, true); err != nil {
+				t.Fatal(err)
+			}
+			for i, path := range append([]string{"users/" + testUserID}, tt.messages...) {
+				// m2 belongs to the other user
+				if _, ok := backend.Get(path); ok != (i == 2) {
+					t.Errorf("%s exists: %v", path, ok)
+				}
+			}
+			chat, _ := backend.Get("gcs/" + testChatID)
+			if want := []interface{}{testOtherID}; !reflect.DeepEqual(chat["users"], want) {
+				t.Errorf("got users %v, want %v", chat["users"], want)
+			}
+		})
+	}
+}
+
+func TestReferenceResolve(t *testing.T) {
+	messages := Ref("gcs", testChatID).Sub("messages").Where("userId", "==", testUserID).Locator("message")
+	firestoreLoc, err := NewMemoryBackend(FirestoreStyle).ResolveReference(messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testLocator("message", Collection, []string{"gcs", "messages"}, []string{testChatID}, "", nil)
+	want.Filters = []Filter{{Path: "userId", Op: "==", Value: testUserID}}
+	if !reflect.DeepEqual(firestoreLoc, want) {
+		t.Errorf("got %+v, want %+v", firestoreLoc, want)
+	}
+
+	mongoLoc, err := NewMemoryBackend(MongoStyle).ResolveReference(Ref("users", testUserID).Locator("user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = testLocator("user", Document, nil, nil, "users", bson.D{{Key: "_id", Value: objectID(t, testUserID)}})
+	if !reflect.DeepEqual(mongoLoc, want) {
+		t.Errorf("got %+v, want %+v", mongoLoc, want)
+	}
+
+	for _, loc := range []Locator{
+		messages,
+		CollectionRef("gcs").Sub("messages").Locator("message"),
+		Ref("gcs", testChatID).Where("users", "==", testUserID).Locator("groupchat"),
+		CollectionRef("gcs").ParentField("chatId").Where("users", "~", testUserID).Locator("groupchat"),
+	} {
+		if _, err := NewMemoryBackend(MongoStyle).ResolveReference(loc); err == nil {
+			t.Errorf("got no error resolving %s in MongoDB", loc.Ref)
+		}
+	}
+
+	_, err = NewClient(&countingBackend{Backend: newTestFirestoreBackend(t)}).ProcessAccessRequestWithContext(context.Background(), refHandleAccess, Ref("users", testUserID).Locator("user"), testUserID)
+	if err == nil {
+		t.Error("got no error using a reference with a backend that cannot resolve it")
+	}
+}
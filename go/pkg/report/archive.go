@@ -0,0 +1,186 @@
+package report
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+// ManifestFile is the name of the manifest in an archive written by
+// WriteArchive.
+const ManifestFile = "manifest.json"
+
+const defaultTitle = "Access report"
+
+// ArchiveInfo describes the access request an archive is made for.
+type ArchiveInfo struct {
+	SubjectID   string
+	RequestedAt time.Time
+	// Title heads the HTML page and the README. It defaults to "Access
+	// report".
+	Title string
+}
+
+// Manifest describes the files of an archive written by WriteArchive.
+type Manifest struct {
+	SubjectID   string    `json:"subjectId"`
+	RequestedAt time.Time `json:"requestedAt"`
+	// LibraryVersion is the version of this module the archive was made
+	// with, or "(devel)" if it is not known.
+	LibraryVersion string `json:"libraryVersion"`
+	// Documents holds the number of documents in the report per DataType,
+	// as in Tables.
+	Documents map[string]int `json:"documents"`
+	// Files lists every other file of the archive, in the order they are
+	// stored.
+	Files []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// WriteArchive writes a zip archive to w holding report as report.json,
+// report.html and one CSV file per DataType under csv/, along with a
+// README.txt for the data subject and a ManifestFile. The same report and
+// info always yield the same files in the same order, and every file is
+// dated info.RequestedAt, so archives of the same report are identical.
+func WriteArchive(w io.Writer, report map[string]interface{}, info ArchiveInfo) error {
+	if info.Title == "" {
+		info.Title = defaultTitle
+	}
+	info.RequestedAt = info.RequestedAt.UTC()
+	tables := Tables(report)
+
+	var files []archiveFile
+	add := func(name string, write func(io.Writer) error) error {
+		var b bytes.Buffer
+		if err := write(&b); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+		files = append(files, archiveFile{name: name, content: b.Bytes()})
+		return nil
+	}
+	if err := add("README.txt", func(w io.Writer) error { return writeReadme(w, info, tables) }); err != nil {
+		return err
+	}
+	if err := add("report.json", func(w io.Writer) error { return WriteJSON(w, report) }); err != nil {
+		return err
+	}
+	if err := add("report.html", func(w io.Writer) error { return WriteHTML(w, report, info.Title) }); err != nil {
+		return err
+	}
+	for i, name := range csvFileNames(tables) {
+		if err := add(name, tables[i].WriteCSV); err != nil {
+			return err
+		}
+	}
+
+	manifest := Manifest{
+		SubjectID:      info.SubjectID,
+		RequestedAt:    info.RequestedAt,
+		LibraryVersion: libraryVersion(),
+		Documents:      make(map[string]int, len(tables)),
+		Files:          make([]ManifestEntry, len(files)),
+	}
+	for _, table := range tables {
+		manifest.Documents[table.Name] = len(table.Rows)
+	}
+	for i, file := range files {
+		sum := sha256.Sum256(file.content)
+		manifest.Files[i] = ManifestEntry{Name: file.name, Size: len(file.content), SHA256: hex.EncodeToString(sum[:])}
+	}
+	if err := add(ManifestFile, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(manifest)
+	}); err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: info.RequestedAt})
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(file.content); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+type archiveFile struct {
+	name    string
+	content []byte
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// csvFileNames returns a distinct file name under csv/ for each table.
+func csvFileNames(tables []Table) []string {
+	names := make([]string, len(tables))
+	used := make(map[string]bool)
+	for i, table := range tables {
+		base := strings.Trim(unsafeFileNameChars.ReplaceAllString(table.Name, "_"), ".")
+		if base == "" {
+			base = "data"
+		}
+		name := "csv/" + base + ".csv"
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("csv/%s-%d.csv", base, n)
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// libraryVersion returns the version of this module in the running binary.
+func libraryVersion() string {
+	const module = "github.com/privacy-pal/privacy-pal/go"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == module && info.Main.Version != "" {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == module {
+				return dep.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+func writeReadme(w io.Writer, info ArchiveInfo, tables []Table) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%s\n\n", info.Title, strings.Repeat("=", len(info.Title)))
+	fmt.Fprintf(&b, "This archive holds the personal data we store about you (subject ID %s),\n", info.SubjectID)
+	fmt.Fprintf(&b, "as collected on %s.\n\n", info.RequestedAt.Format(time.RFC3339))
+	b.WriteString("Files:\n\n")
+	fmt.Fprintf(&b, "  %-16s %s\n", "report.html", "The data as a page you can open in any web browser.")
+	fmt.Fprintf(&b, "  %-16s %s\n", "report.json", "The same data in JSON, a format other services can import.")
+	for i, name := range csvFileNames(tables) {
+		fmt.Fprintf(&b, "  %-16s Your %s data as a table, one row per record.\n", name, tables[i].Name)
+	}
+	fmt.Fprintf(&b, "  %-16s %s\n\n", ManifestFile, "The SHA-256 checksum of every file, to check that none was changed.")
+	fmt.Fprintf(&b, "Every record in report.json names its kind of data under %q.\n", pal.DataTypeKey)
+	fmt.Fprintf(&b, "An entry such as {%q: ...} points to a record that appears elsewhere in the\n", pal.ReferenceKey)
+	fmt.Fprintf(&b, "report. Entries %q and %q mark parts that could not be included,\n", pal.TruncatedKey, pal.ErrorKey)
+	fmt.Fprintf(&b, "and the %q section, if present, lists them.\n", pal.ErrorsKey)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
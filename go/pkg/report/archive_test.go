@@ -0,0 +1,82 @@
+package report
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+func TestWriteArchive(t *testing.T) {
+	info := ArchiveInfo{SubjectID: "u1", RequestedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("EST", -5*3600))}
+	var first, second bytes.Buffer
+	if err := WriteArchive(&first, newReport(t, pal.WithProvenance()), info); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteArchive(&second, newReport(t, pal.WithProvenance()), info); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("got different archives for the same report")
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(first.Bytes()), int64(first.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string][]byte)
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents[file.Name], err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantNames := []string{"README.txt", "report.json", "report.html", "csv/chat.csv", "csv/user.csv", ManifestFile}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("got files %v, want %v", names, wantNames)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(contents[ManifestFile], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SubjectID != "u1" || !manifest.RequestedAt.Equal(info.RequestedAt) || manifest.LibraryVersion == "" {
+		t.Errorf("got manifest %+v", manifest)
+	}
+	if want := map[string]int{"chat": 2, "user": 1}; !reflect.DeepEqual(manifest.Documents, want) {
+		t.Errorf("got documents %v, want %v", manifest.Documents, want)
+	}
+	if len(manifest.Files) != len(wantNames)-1 {
+		t.Fatalf("got %d files in the manifest, want %d", len(manifest.Files), len(wantNames)-1)
+	}
+	for i, entry := range manifest.Files {
+		sum := sha256.Sum256(contents[entry.Name])
+		if entry.Name != wantNames[i] || entry.SHA256 != hex.EncodeToString(sum[:]) || entry.Size != len(contents[entry.Name]) {
+			t.Errorf("manifest entry %+v does not match the file", entry)
+		}
+	}
+	if readme := string(contents["README.txt"]); !strings.Contains(readme, "subject ID u1") || !strings.Contains(readme, "csv/chat.csv") {
+		t.Errorf("got README:\n%s", readme)
+	}
+}
+
+func TestCSVFileNames(t *testing.T) {
+	tables := []Table{{Name: "chat message"}, {Name: "chat/message"}, {Name: ".."}}
+	want := []string{"csv/chat_message.csv", "csv/chat_message-2.csv", "csv/data.csv"}
+	if got := csvFileNames(tables); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package report
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Canonical returns the canonical JSON encoding of value, such as an access
+// report: the same data always yields the same bytes. The encoding is compact
+// and sorts object keys by their bytes. Numbers are written in their
+// shortest form, so int64(3), int32(3) and 3.0 all encode as 3; integers are
+// kept exact. Timestamps are RFC 3339 strings in UTC. The MongoDB backend
+// already hands handlers plain Go values, but BSON types a handler may have
+// read with the driver are normalized too: dates like timestamps, ObjectIDs
+// as hex strings and bson.D like maps. Values of other types, such as
+// DeletionResult, are first converted to JSON with encoding/json.
+//
+// ProcessAccessRequest lists the documents of a collection by document ID, so
+// reports of the same data are canonically equal whatever order the backend
+// returns them in.
+func Canonical(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := writeCanonical(&b, value); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Hash returns the SHA-256 of the canonical encoding of value, as
+// "sha256:" followed by the hex digest.
+func Hash(value interface{}) (string, error) {
+	encoded, err := Canonical(value)
+	if err != nil {
+		return "", err
+	}
+	return sha256Hash(encoded), nil
+}
+
+func sha256Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func writeCanonical(b *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		b.WriteString("null")
+		return nil
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+		return nil
+	case string:
+		return writeCanonicalString(b, v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		fmt.Fprint(b, v)
+		return nil
+	case float32:
+		// the shortest decimal that reads back as v, not its float64 widening
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+		return writeCanonicalFloat(b, f)
+	case float64:
+		return writeCanonicalFloat(b, v)
+	case json.Number:
+		return writeCanonicalNumber(b, v)
+	case time.Time:
+		return writeCanonicalString(b, v.UTC().Format(time.RFC3339Nano))
+	case primitive.DateTime:
+		return writeCanonicalString(b, v.Time().UTC().Format(time.RFC3339Nano))
+	case primitive.ObjectID:
+		return writeCanonicalString(b, v.Hex())
+	case primitive.Decimal128:
+		return writeCanonicalNumber(b, json.Number(v.String()))
+	case []byte:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(encoded)
+		return nil
+	case bson.D:
+		object := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			object[e.Key] = e.Value
+		}
+		return writeCanonicalObject(b, object)
+	}
+
+	if object, ok := asObject(value); ok {
+		return writeCanonicalObject(b, object)
+	}
+	if list, ok := asList(value); ok {
+		b.WriteByte('[')
+		for i, elem := range list {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			if err := writeCanonical(b, elem); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+		return nil
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Pointer && v.IsNil() {
+		b.WriteString("null")
+		return nil
+	}
+
+	// structs and other types: go through their JSON encoding
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+	return writeCanonical(b, decoded)
+}
+
+func writeCanonicalObject(b *bytes.Buffer, object map[string]interface{}) error {
+	b.WriteByte('{')
+	for i, key := range sortedKeys(object) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := writeCanonicalString(b, key); err != nil {
+			return err
+		}
+		b.WriteByte(':')
+		if err := writeCanonical(b, object[key]); err != nil {
+			return err
+		}
+	}
+	b.WriteByte('}')
+	return nil
+}
+
+func writeCanonicalString(b *bytes.Buffer, s string) error {
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	b.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
+	return nil
+}
+
+func writeCanonicalFloat(b *bytes.Buffer, f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("cannot encode %v in JSON", f)
+	}
+	if f == 0 {
+		// no negative zero
+		f = 0
+	}
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	b.Write(encoded)
+	return nil
+}
+
+// writeCanonicalNumber writes a decimal number: exactly if it is an integer,
+// and as a float64 otherwise.
+func writeCanonicalNumber(b *bytes.Buffer, n json.Number) error {
+	if i, ok := new(big.Int).SetString(string(n), 10); ok {
+		b.WriteString(i.String())
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", n)
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		// an integer written with a fraction or exponent, such as 3.0
+		i, _ := new(big.Float).SetFloat64(f).Int(nil)
+		b.WriteString(i.String())
+		return nil
+	}
+	return writeCanonicalFloat(b, f)
+}
@@ -0,0 +1,147 @@
+package report
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCanonical(t *testing.T) {
+	at := time.Date(2024, 5, 1, 7, 0, 0, 500, time.FixedZone("EST", -5*3600))
+	objectID, err := primitive.ObjectIDFromHex("64b7f0c2a1b2c3d4e5f60001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{map[string]interface{}{"b": 1, "a": []interface{}{"x", nil, true}, "<": "&"}, `{"<":"&","a":["x",null,true],"b":1}`},
+		{[]interface{}{int64(3), int32(3), 3.0, float32(0.1), 0.1, math.Copysign(0, -1), uint64(math.MaxUint64)}, `[3,3,3,0.1,0.1,0,18446744073709551615]`},
+		{[]interface{}{1e21, 1.5e-7}, `[1e+21,1.5e-7]`},
+		{at, `"2024-05-01T12:00:00.0000005Z"`},
+		{primitive.NewDateTimeFromTime(at), `"2024-05-01T12:00:00Z"`},
+		{objectID, `"64b7f0c2a1b2c3d4e5f60001"`},
+		{bson.D{{Key: "z", Value: bson.A{1}}, {Key: "y", Value: bson.M{"n": 2.50}}}, `{"y":{"n":2.5},"z":[1]}`},
+		{map[string]string{"k": "v"}, `{"k":"v"}`},
+		{struct {
+			Name  string  `json:"name"`
+			Count float64 `json:"count"`
+			Big   int64   `json:"big"`
+		}{"n", 2, math.MaxInt64}, `{"big":9223372036854775807,"count":2,"name":"n"}`},
+	}
+	for _, tt := range tests {
+		got, err := Canonical(tt.value)
+		if err != nil {
+			t.Errorf("Canonical(%v): %v", tt.value, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("Canonical(%v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+
+	if _, err := Canonical(map[string]interface{}{"n": math.NaN()}); err == nil {
+		t.Error("got no error encoding NaN")
+	}
+}
+
+// reversingBackend returns query results in reverse order of document ID.
+type reversingBackend struct {
+	*pal.MemoryBackend
+}
+
+func (b reversingBackend) GetDocuments(ctx context.Context, loc pal.Locator) ([]pal.LocatorAndObject, error) {
+	locAndObjs, err := b.MemoryBackend.GetDocuments(ctx, loc)
+	for i, j := 0, len(locAndObjs)-1; i < j; i, j = i+1, j-1 {
+		locAndObjs[i], locAndObjs[j] = locAndObjs[j], locAndObjs[i]
+	}
+	return locAndObjs, err
+}
+
+func TestHash(t *testing.T) {
+	want, err := Hash(newReport(t, pal.WithProvenance()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := pal.NewMemoryBackend(pal.FirestoreStyle)
+	docs := map[string]map[string]interface{}{
+		"users/u1": {"name": "user1", "profile": map[string]interface{}{"bio": "<b>hi</b>, \"all\"", "city": "Providence"}},
+		"chats/c1": {"title": "first", "users": []interface{}{"u1"}, "tags": []interface{}{"a", "b"}},
+		"chats/c2": {"title": "second", "users": []interface{}{"u1"}},
+	}
+	for path, doc := range docs {
+		if err := backend.Put(path, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := pal.NewClient(reversingBackend{backend}).ProcessAccessRequest(handleAccess, pal.Ref("users", "u1").Locator("user"), "u1", pal.WithProvenance())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Hash(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got hash %s for results in reverse order, want %s", got, want)
+	}
+
+	report["Name"] = "user2"
+	if changed, _ := Hash(report); changed == want {
+		t.Error("got the same hash for a different report")
+	}
+}
+
+// TestHashMongo checks that a report of MongoDB documents, with the BSON types
+// the driver decodes, hashes like the same report from Firestore.
+func TestHashMongo(t *testing.T) {
+	joined := time.Date(2023, 7, 19, 12, 30, 0, 0, time.UTC)
+	firestoreBackend := pal.NewMemoryBackend(pal.FirestoreStyle)
+	if err := firestoreBackend.Put("users/u1", map[string]interface{}{
+		"name":    "user1",
+		"profile": map[string]interface{}{"joined": joined, "visits": int64(5), "score": 2.5},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := bson.Marshal(bson.D{
+		{Key: "name", Value: "user1"},
+		{Key: "profile", Value: bson.D{
+			{Key: "joined", Value: primitive.NewDateTimeFromTime(joined)},
+			{Key: "visits", Value: int32(5)},
+			{Key: "score", Value: 2.5},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var user bson.M
+	if err := bson.Unmarshal(raw, &user); err != nil {
+		t.Fatal(err)
+	}
+	mongoBackend := pal.NewMemoryBackend(pal.MongoStyle)
+	if err := mongoBackend.Put("users/u1", user); err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := make([]string, 2)
+	for i, backend := range []*pal.MemoryBackend{firestoreBackend, mongoBackend} {
+		report, err := pal.NewClient(backend).ProcessAccessRequest(handleAccess, pal.Ref("users", "u1").Locator("user"), "u1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hashes[i], err = Hash(report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("got hash %s for the MongoDB report, want %s as for Firestore", hashes[1], hashes[0])
+	}
+}
@@ -0,0 +1,143 @@
+package report
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+// ReportTable names the table of the documents whose DataType the report does
+// not record.
+const ReportTable = "report"
+
+// Table is the CSV rendering of the documents of one DataType: a row for each
+// document, with nested objects flattened into columns such as
+// "profile.city" and "tags[0]".
+type Table struct {
+	// Name is the DataType of the documents.
+	Name string
+	// Header starts with "$path", "$collection" and "$documentId", taken from
+	// pal.ProvenanceKey, followed by the fields of the documents in the order
+	// they first appear. Without provenance, "$path" is the path of the
+	// document in the report and the others are empty.
+	Header []string
+	Rows   [][]string
+}
+
+// Tables splits report into one table per DataType, in order of name. A
+// document is the data subject or an object with pal.DataTypeKey or
+// pal.ProvenanceKey, and its DataType is taken from either of them. The
+// documents nested in another document are rows of their own table and are
+// left out of its row.
+func Tables(report map[string]interface{}) []Table {
+	builder := tableBuilder{tables: make(map[string]*tableData)}
+	builder.addDocument("", report)
+
+	names := make([]string, 0, len(builder.tables))
+	for name := range builder.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tables := make([]Table, len(names))
+	for i, name := range names {
+		data := builder.tables[name]
+		table := Table{Name: name, Header: append([]string{"$path", "$collection", "$documentId"}, data.columns...)}
+		for _, row := range data.rows {
+			cells := make([]string, len(table.Header))
+			for j, column := range table.Header {
+				cells[j] = row[column]
+			}
+			table.Rows = append(table.Rows, cells)
+		}
+		tables[i] = table
+	}
+	return tables
+}
+
+// WriteCSV writes t to w, header first.
+func (t Table) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(t.Header); err != nil {
+		return err
+	}
+	if err := writer.WriteAll(t.Rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+type tableData struct {
+	columns []string
+	seen    map[string]bool
+	rows    []map[string]string
+}
+
+type tableBuilder struct {
+	tables map[string]*tableData
+}
+
+// addDocument adds a row for the document at path, and rows for the
+// documents nested in it.
+func (b *tableBuilder) addDocument(path string, document map[string]interface{}) {
+	name := ReportTable
+	if dataType, ok := document[pal.DataTypeKey]; ok {
+		name = scalar(dataType)
+	}
+	row := map[string]string{"$path": path}
+	if provenance, ok := asObject(document[pal.ProvenanceKey]); ok {
+		name = scalar(provenance["dataType"])
+		row["$path"] = scalar(provenance["path"])
+		row["$collection"] = scalar(provenance["collection"])
+		row["$documentId"] = scalar(provenance["documentId"])
+	}
+	table, ok := b.tables[name]
+	if !ok {
+		table = &tableData{seen: make(map[string]bool)}
+		b.tables[name] = table
+	}
+	// the row goes before those of nested documents
+	table.rows = append(table.rows, row)
+	for _, key := range sortedKeys(document) {
+		if key != pal.ProvenanceKey && key != pal.DataTypeKey {
+			b.addField(table, row, key, keyPath(path, key), document[key])
+		}
+	}
+}
+
+// addField adds value, found at path in the report, to row under column, or
+// as a row of its own if it is a document.
+func (b *tableBuilder) addField(table *tableData, row map[string]string, column string, path string, value interface{}) {
+	if object, ok := asObject(value); ok {
+		if isDocument(object) {
+			b.addDocument(path, object)
+			return
+		}
+		for _, k := range sortedKeys(object) {
+			b.addField(table, row, keyPath(column, k), keyPath(path, k), object[k])
+		}
+		return
+	}
+	if list, ok := asList(value); ok {
+		for i, elem := range list {
+			b.addField(table, row, indexPath(column, i), indexPath(path, i), elem)
+		}
+		return
+	}
+	if !table.seen[column] {
+		table.seen[column] = true
+		table.columns = append(table.columns, column)
+	}
+	row[column] = scalar(value)
+}
+
+// isDocument reports whether object holds the data of a document rather than
+// a nested object of one.
+func isDocument(object map[string]interface{}) bool {
+	_, ok := object[pal.DataTypeKey]
+	if !ok {
+		_, ok = object[pal.ProvenanceKey]
+	}
+	return ok
+}
@@ -0,0 +1,83 @@
+package report
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+const htmlStyle = `body{font-family:sans-serif;margin:2em;color:#222}
+details{margin:.25em 0 .25em 1.25em}
+summary{cursor:pointer;font-weight:bold}
+.field{margin:.25em 0 .25em 1.25em}
+.key{color:#555}
+.type,.source{color:#888;font-weight:normal;font-size:.9em}
+.note{color:#a40}`
+
+// WriteHTML writes report to w as a self-contained HTML page with the given
+// title. Every object and list is a collapsible section, and documents show
+// their DataType, and the source recorded under pal.ProvenanceKey if any.
+func WriteHTML(w io.Writer, report map[string]interface{}, title string) error {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n")
+	b.WriteString("<title>" + html.EscapeString(title) + "</title>\n")
+	b.WriteString("<style>\n" + htmlStyle + "\n</style>\n</head>\n<body>\n")
+	b.WriteString("<h1>" + html.EscapeString(title) + "</h1>\n")
+	writeHTMLObject(&b, report)
+	b.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHTMLObject(b *strings.Builder, object map[string]interface{}) {
+	if provenance, ok := asObject(object[pal.ProvenanceKey]); ok {
+		b.WriteString("<div class=\"source\">" + html.EscapeString(scalar(provenance["collection"])+"/"+scalar(provenance["documentId"])) + "</div>\n")
+	}
+	for _, key := range sortedKeys(object) {
+		if key != pal.ProvenanceKey && key != pal.DataTypeKey {
+			writeHTMLValue(b, key, object[key])
+		}
+	}
+}
+
+func writeHTMLValue(b *strings.Builder, label string, value interface{}) {
+	if object, ok := asObject(value); ok {
+		for _, key := range []string{pal.ReferenceKey, pal.TruncatedKey, pal.ErrorKey} {
+			if note, ok := object[key]; ok && len(object) == 1 {
+				b.WriteString("<div class=\"field\"><span class=\"key\">" + html.EscapeString(label) + "</span> ")
+				b.WriteString("<span class=\"note\">" + html.EscapeString(key+" "+scalar(note)) + "</span></div>\n")
+				return
+			}
+		}
+		b.WriteString("<details open>\n<summary>" + html.EscapeString(label))
+		if dataType, ok := object[pal.DataTypeKey]; ok {
+			b.WriteString(" <span class=\"type\">" + html.EscapeString(scalar(dataType)) + "</span>")
+		} else if provenance, ok := asObject(object[pal.ProvenanceKey]); ok {
+			b.WriteString(" <span class=\"type\">" + html.EscapeString(scalar(provenance["dataType"])) + "</span>")
+		}
+		b.WriteString("</summary>\n")
+		writeHTMLObject(b, object)
+		b.WriteString("</details>\n")
+		return
+	}
+	if list, ok := asList(value); ok {
+		b.WriteString("<details open>\n<summary>" + html.EscapeString(label) + " <span class=\"type\">" + html.EscapeString(itemCount(len(list))) + "</span></summary>\n")
+		for i, elem := range list {
+			writeHTMLValue(b, indexPath("", i), elem)
+		}
+		b.WriteString("</details>\n")
+		return
+	}
+	b.WriteString("<div class=\"field\"><span class=\"key\">" + html.EscapeString(label) + "</span> ")
+	b.WriteString(html.EscapeString(scalar(value)) + "</div>\n")
+}
+
+func itemCount(n int) string {
+	if n == 1 {
+		return "1 item"
+	}
+	return fmt.Sprintf("%d items", n)
+}
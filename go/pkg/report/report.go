@@ -0,0 +1,95 @@
+// Package report renders the access reports returned by
+// ProcessAccessRequest for data subjects: as pretty JSON, as one CSV table per
+// DataType, and as a self-contained HTML page. WriteArchive bundles all of
+// them into a zip archive with a manifest. Canonical and Hash give a report
+// a byte-for-byte stable encoding and a content hash.
+//
+// CSV tables are split by the DataType recorded under pal.DataTypeKey, and
+// take the collection and document ID of each row from pal.ProvenanceKey if
+// the report was made with pal.WithProvenance.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// WriteJSON writes report to w as indented JSON with sorted keys.
+func WriteJSON(w io.Writer, report map[string]interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scalar returns the text of a value that is neither an object nor a list:
+// strings as they are, nil as an empty string, and anything else in JSON.
+func scalar(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// asObject returns value as an object if it is a map with string keys.
+func asObject(value interface{}) (map[string]interface{}, bool) {
+	if object, ok := value.(map[string]interface{}); ok {
+		return object, true
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	object := make(map[string]interface{}, v.Len())
+	for iter := v.MapRange(); iter.Next(); {
+		object[iter.Key().String()] = iter.Value().Interface()
+	}
+	return object, true
+}
+
+// asList returns value as a list if it is a slice or array, other than bytes.
+func asList(value interface{}) ([]interface{}, bool) {
+	if list, ok := value.([]interface{}); ok {
+		return list, true
+	}
+	v := reflect.ValueOf(value)
+	if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	list := make([]interface{}, v.Len())
+	for i := range list {
+		list[i] = v.Index(i).Interface()
+	}
+	return list, true
+}
+
+// keyPath and indexPath build paths in the form of pal.TraversalError.Path,
+// such as "Groupchats[0].Messages".
+func keyPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
@@ -0,0 +1,149 @@
+package report
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+func handleAccess(dataSubjectId string, currentDbObjLocator pal.Locator, dbObj pal.DatabaseObject) (map[string]interface{}, error) {
+	switch currentDbObjLocator.DataType {
+	case "user":
+		return map[string]interface{}{
+			"Name":    dbObj["name"],
+			"Profile": dbObj["profile"],
+			"Chats":   pal.CollectionRef("chats").Where("users", "array-contains", dbObj["_id"]).Locator("chat"),
+		}, nil
+	default:
+		return map[string]interface{}{"Title": dbObj["title"], "Tags": dbObj["tags"]}, nil
+	}
+}
+
+func newReport(t *testing.T, opts ...pal.RequestOption) map[string]interface{} {
+	backend := pal.NewMemoryBackend(pal.FirestoreStyle)
+	docs := map[string]map[string]interface{}{
+		"users/u1": {"name": "user1", "profile": map[string]interface{}{"city": "Providence", "bio": "<b>hi</b>, \"all\""}},
+		"chats/c1": {"title": "first", "users": []interface{}{"u1"}, "tags": []interface{}{"a", "b"}},
+		"chats/c2": {"title": "second", "users": []interface{}{"u1"}},
+	}
+	for path, doc := range docs {
+		if err := backend.Put(path, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := pal.NewClient(backend).ProcessAccessRequest(handleAccess, pal.Ref("users", "u1").Locator("user"), "u1", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteJSON(&b, newReport(t)); err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "$dataType": "user",
+  "Chats": [
+    {
+      "$dataType": "chat",
+      "Tags": [
+        "a",
+        "b"
+      ],
+      "Title": "first"
+    },
+    {
+      "$dataType": "chat",
+      "Tags": null,
+      "Title": "second"
+    }
+  ],
+  "Name": "user1",
+  "Profile": {
+    "bio": "<b>hi</b>, \"all\"",
+    "city": "Providence"
+  }
+}
+`
+	if b.String() != want {
+		t.Errorf("got %s, want %s", b.String(), want)
+	}
+}
+
+func TestTables(t *testing.T) {
+	want := []Table{
+		{
+			Name:   "chat",
+			Header: []string{"$path", "$collection", "$documentId", "Tags[0]", "Tags[1]", "Title", "Tags"},
+			Rows: [][]string{
+				{"Chats[0]", "chats", "c1", "a", "b", "first", ""},
+				{"Chats[1]", "chats", "c2", "", "", "second", ""},
+			},
+		},
+		{
+			Name:   "user",
+			Header: []string{"$path", "$collection", "$documentId", "Name", "Profile.bio", "Profile.city"},
+			Rows:   [][]string{{"", "users", "u1", "user1", "<b>hi</b>, \"all\"", "Providence"}},
+		},
+	}
+	tables := Tables(newReport(t, pal.WithProvenance()))
+	if !reflect.DeepEqual(tables, want) {
+		t.Errorf("got tables %v, want %v", tables, want)
+	}
+
+	var b bytes.Buffer
+	if err := tables[1].WriteCSV(&b); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "$path,$collection,$documentId,Name,Profile.bio,Profile.city\n,users,u1,user1,\"<b>hi</b>, \"\"all\"\"\",Providence\n"
+	if b.String() != wantCSV {
+		t.Errorf("got CSV %q, want %q", b.String(), wantCSV)
+	}
+
+	// without provenance, the tables are still split by DataType, but the
+	// rows do not know their collection and document ID
+	for i := range want {
+		for _, row := range want[i].Rows {
+			row[1], row[2] = "", ""
+		}
+	}
+	if plain := Tables(newReport(t)); !reflect.DeepEqual(plain, want) {
+		t.Errorf("got tables %v without provenance, want %v", plain, want)
+	}
+
+	untyped := map[string]interface{}{"Name": "user1", "Chats": []interface{}{map[string]interface{}{"Title": "first"}}}
+	wantUntyped := []Table{{
+		Name:   ReportTable,
+		Header: []string{"$path", "$collection", "$documentId", "Chats[0].Title", "Name"},
+		Rows:   [][]string{{"", "", "", "first", "user1"}},
+	}}
+	if plain := Tables(untyped); !reflect.DeepEqual(plain, wantUntyped) {
+		t.Errorf("got tables %v without data types, want %v", plain, wantUntyped)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteHTML(&b, newReport(t, pal.WithProvenance()), "Your data & more"); err != nil {
+		t.Fatal(err)
+	}
+	page := b.String()
+	for _, want := range []string{
+		"<title>Your data &amp; more</title>",
+		"<details open>\n<summary>Chats <span class=\"type\">2 items</span></summary>",
+		"<summary>[0] <span class=\"type\">chat</span></summary>\n<div class=\"source\">chats/c1</div>",
+		"&lt;b&gt;hi&lt;/b&gt;, &#34;all&#34;",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page does not contain %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "<b>hi</b>") || strings.Contains(page, pal.ProvenanceKey) || strings.Contains(page, pal.DataTypeKey) {
+		t.Errorf("page holds unescaped values or provenance keys:\n%s", page)
+	}
+}
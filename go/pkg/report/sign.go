@@ -0,0 +1,106 @@
+package report
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+// Kinds of SignedBundle.
+const (
+	AccessReportKind   = "access-report"
+	DeletionResultKind = "deletion-result"
+)
+
+// ErrInvalidSignature is returned, wrapped, by Verify when a bundle was not
+// signed with the given key or was changed after it was signed.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// SignedBundle is an access report or deletion result in canonical form,
+// signed with Ed25519, so that anyone holding the public key can prove what
+// was produced and when. Store or send it as JSON; the palverify command
+// checks such a file offline.
+type SignedBundle struct {
+	// Kind is AccessReportKind or DeletionResultKind.
+	Kind     string    `json:"kind"`
+	SignedAt time.Time `json:"signedAt"`
+	// Payload is the canonical encoding of the report or result, see
+	// Canonical.
+	Payload json.RawMessage `json:"payload"`
+	// Hash is the SHA-256 of Payload in the form returned by Hash.
+	Hash      string            `json:"hash"`
+	PublicKey ed25519.PublicKey `json:"publicKey"`
+	// Signature signs the canonical encoding of an object holding Kind,
+	// SignedAt and Hash.
+	Signature []byte `json:"signature"`
+}
+
+// SignAccessReport signs the canonical form of report with key.
+func SignAccessReport(report map[string]interface{}, key ed25519.PrivateKey, signedAt time.Time) (*SignedBundle, error) {
+	return sign(AccessReportKind, report, key, signedAt)
+}
+
+// SignDeletionResult signs the canonical form of result with key.
+func SignDeletionResult(result *pal.DeletionResult, key ed25519.PrivateKey, signedAt time.Time) (*SignedBundle, error) {
+	return sign(DeletionResultKind, result, key, signedAt)
+}
+
+func sign(kind string, value interface{}, key ed25519.PrivateKey, signedAt time.Time) (*SignedBundle, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 private key of %d bytes", len(key))
+	}
+	payload, err := Canonical(value)
+	if err != nil {
+		return nil, err
+	}
+	bundle := &SignedBundle{
+		Kind:      kind,
+		SignedAt:  signedAt.UTC(),
+		Payload:   payload,
+		Hash:      sha256Hash(payload),
+		PublicKey: key.Public().(ed25519.PublicKey),
+	}
+	message, err := bundle.message()
+	if err != nil {
+		return nil, err
+	}
+	bundle.Signature = ed25519.Sign(key, message)
+	return bundle, nil
+}
+
+// Verify checks that bundle was signed with the private key of key and has
+// not been changed since.
+func Verify(bundle *SignedBundle, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid Ed25519 public key of %d bytes", len(key))
+	}
+	if len(bundle.PublicKey) > 0 && !bytes.Equal(bundle.PublicKey, key) {
+		return fmt.Errorf("%w: bundle names a different public key", ErrInvalidSignature)
+	}
+	// the payload may have been reformatted and its <, > and & escaped, e.g.
+	// by json.MarshalIndent
+	payload, err := Canonical(bundle.Payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if hash := sha256Hash(payload); hash != bundle.Hash {
+		return fmt.Errorf("%w: payload hash is %s, bundle says %s", ErrInvalidSignature, hash, bundle.Hash)
+	}
+	message, err := bundle.message()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, message, bundle.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (b *SignedBundle) message() ([]byte, error) {
+	return Canonical(map[string]interface{}{"kind": b.Kind, "signedAt": b.SignedAt, "hash": b.Hash})
+}
@@ -0,0 +1,97 @@
+package report
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	pal "github.com/privacy-pal/privacy-pal/go/pkg"
+)
+
+func TestSignAccessReport(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{1}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newReport(t, pal.WithProvenance())
+	signedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	bundle, err := SignAccessReport(report, privateKey, signedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := Hash(report); bundle.Hash != hash || bundle.Kind != AccessReportKind {
+		t.Errorf("got bundle %s %s, want %s %s", bundle.Kind, bundle.Hash, AccessReportKind, hash)
+	}
+
+	// a bundle stored as JSON, even reformatted, still verifies
+	encoded, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded SignedBundle
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(&decoded, publicKey); err != nil {
+		t.Errorf("got error %v verifying the bundle", err)
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{2}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := func(change func(*SignedBundle)) *SignedBundle {
+		b := decoded
+		change(&b)
+		return &b
+	}
+	for name, b := range map[string]*SignedBundle{
+		"payload":   tampered(func(b *SignedBundle) { b.Payload = bytes.Replace(b.Payload, []byte("user1"), []byte("user2"), 1) }),
+		"hash":      tampered(func(b *SignedBundle) { b.Hash = "sha256:00" }),
+		"time":      tampered(func(b *SignedBundle) { b.SignedAt = b.SignedAt.Add(time.Hour) }),
+		"kind":      tampered(func(b *SignedBundle) { b.Kind = DeletionResultKind }),
+		"signature": tampered(func(b *SignedBundle) { b.Signature = append([]byte{b.Signature[0] ^ 1}, b.Signature[1:]...) }),
+	} {
+		if err := Verify(b, publicKey); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s changed: got error %v, want ErrInvalidSignature", name, err)
+		}
+	}
+	if err := Verify(&decoded, otherKey); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("got error %v verifying with another key, want ErrInvalidSignature", err)
+	}
+}
+
+func TestSignDeletionResult(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(bytes.NewReader(bytes.Repeat([]byte{1}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := pal.NewMemoryBackend(pal.FirestoreStyle)
+	if err := backend.Put("users/u1", map[string]interface{}{"name": "user1"}); err != nil {
+		t.Fatal(err)
+	}
+	handleDeletion := func(dataSubjectId string, currentDbObjLocator pal.Locator, dbObj pal.DatabaseObject) ([]pal.Locator, bool, pal.FieldUpdates, error) {
+		return nil, true, pal.FieldUpdates{}, nil
+	}
+	result, err := pal.NewClient(backend).ProcessDeletionRequest(handleDeletion, pal.Ref("users", "u1").Locator("user"), "u1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := SignDeletionResult(result, privateKey, result.StartedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(bundle, publicKey); err != nil {
+		t.Errorf("got error %v verifying the bundle", err)
+	}
+	var payload pal.DeletionResult
+	if err := json.Unmarshal(bundle.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Outcome != pal.DeletionApplied || payload.Counts["user"].Deleted != 1 {
+		t.Errorf("got payload %+v", payload)
+	}
+}
@@ -0,0 +1,141 @@
+package pal
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UpdateOp is the kind of change a FieldUpdate makes.
+type UpdateOp string
+
+const (
+	SetOp          UpdateOp = "set"
+	UnsetOp        UpdateOp = "unset"
+	ArrayRemoveOp  UpdateOp = "arrayRemove"
+	ArrayUnionOp   UpdateOp = "arrayUnion"
+	RemoveMapKeyOp UpdateOp = "removeMapKey"
+	IncrementOp    UpdateOp = "increment"
+)
+
+// FieldUpdate is a change to one field of a document that every backend
+// understands. Build it with Set, Unset, ArrayRemove, ArrayUnion, RemoveMapKey
+// or Increment and return it in FieldUpdates.Updates, so that a HandleDeletion
+// function works on Firestore and MongoDB alike. Path is a dotted path such as
+// "profile.city".
+type FieldUpdate struct {
+	Op   UpdateOp
+	Path string
+	// Key is the map key removed by RemoveMapKey.
+	Key string
+	// Value is the value of Set and the amount of Increment.
+	Value interface{}
+	// Values are the elements of ArrayRemove and ArrayUnion.
+	Values []interface{}
+}
+
+// Set sets the field at path to value.
+func Set(path string, value interface{}) FieldUpdate {
+	return FieldUpdate{Op: SetOp, Path: path, Value: value}
+}
+
+// Unset deletes the field at path.
+func Unset(path string) FieldUpdate {
+	return FieldUpdate{Op: UnsetOp, Path: path}
+}
+
+// ArrayRemove removes every element equal to one of values from the array at
+// path.
+func ArrayRemove(path string, values ...interface{}) FieldUpdate {
+	return FieldUpdate{Op: ArrayRemoveOp, Path: path, Values: values}
+}
+
+// ArrayUnion adds each of values to the array at path, unless it is already
+// there.
+func ArrayUnion(path string, values ...interface{}) FieldUpdate {
+	return FieldUpdate{Op: ArrayUnionOp, Path: path, Values: values}
+}
+
+// RemoveMapKey deletes key from the map at path. Unlike Unset, key is used as
+// is, so it is not split at dots. MongoDB cannot address keys containing dots
+// or starting with "$", so such keys fail on the MongoDB backend.
+func RemoveMapKey(path string, key string) FieldUpdate {
+	return FieldUpdate{Op: RemoveMapKeyOp, Path: path, Key: key}
+}
+
+// Increment adds n, an integer or floating point number, to the number at
+// path.
+func Increment(path string, n interface{}) FieldUpdate {
+	return FieldUpdate{Op: IncrementOp, Path: path, Value: n}
+}
+
+// fieldPath returns the path of the field u changes, as dotted path segments.
+func (u FieldUpdate) fieldPath() []string {
+	path := strings.Split(u.Path, ".")
+	if u.Op == RemoveMapKeyOp {
+		path = append(path, u.Key)
+	}
+	return path
+}
+
+// firestoreUpdates returns the Firestore updates of u: Updates translated into
+// firestore.Update values, followed by FirestoreUpdates.
+func (u FieldUpdates) firestoreUpdates() ([]firestore.Update, error) {
+	var updates []firestore.Update
+	for _, update := range u.Updates {
+		firestoreUpdate := firestore.Update{FieldPath: update.fieldPath()}
+		switch update.Op {
+		case SetOp:
+			firestoreUpdate.Value = update.Value
+		case UnsetOp, RemoveMapKeyOp:
+			firestoreUpdate.Value = firestore.Delete
+		case ArrayRemoveOp:
+			firestoreUpdate.Value = firestore.ArrayRemove(update.Values...)
+		case ArrayUnionOp:
+			firestoreUpdate.Value = firestore.ArrayUnion(update.Values...)
+		case IncrementOp:
+			firestoreUpdate.Value = firestore.Increment(update.Value)
+		default:
+			return nil, fmt.Errorf("unsupported update operation %q on %s", update.Op, update.Path)
+		}
+		updates = append(updates, firestoreUpdate)
+	}
+	return append(updates, u.FirestoreUpdates...), nil
+}
+
+// mongoUpdates returns the MongoDB update documents of u: one document
+// holding Updates translated into $set, $unset, $pull, $addToSet and $inc
+// operators, followed by MongoUpdates.
+func (u FieldUpdates) mongoUpdates() ([]interface{}, error) {
+	if len(u.Updates) == 0 {
+		return u.MongoUpdates, nil
+	}
+
+	var fields []mongoField
+	for _, update := range u.Updates {
+		field := mongoField{path: update.Path}
+		switch update.Op {
+		case SetOp:
+			field.operator, field.value = "$set", update.Value
+		case UnsetOp:
+			field.operator, field.value = "$unset", ""
+		case RemoveMapKeyOp:
+			if strings.Contains(update.Key, ".") || strings.HasPrefix(update.Key, "$") {
+				return nil, fmt.Errorf("map key %q of %s cannot be removed in MongoDB", update.Key, update.Path)
+			}
+			field.operator, field.path, field.value = "$unset", update.Path+"."+update.Key, ""
+		case ArrayRemoveOp:
+			field.operator, field.value = "$pull", bson.D{{Key: "$in", Value: bson.A(update.Values)}}
+		case ArrayUnionOp:
+			field.operator, field.value = "$addToSet", bson.D{{Key: "$each", Value: bson.A(update.Values)}}
+		case IncrementOp:
+			field.operator, field.value = "$inc", update.Value
+		default:
+			return nil, fmt.Errorf("unsupported update operation %q on %s", update.Op, update.Path)
+		}
+		fields = append(fields, field)
+	}
+	return append([]interface{}{mongoUpdateDocument(fields)}, u.MongoUpdates...), nil
+}